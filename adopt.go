@@ -0,0 +1,215 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+type StageEntryKind int
+
+const (
+	// A link to an Object in this store, as LinkedVisitor sees.
+	StageLinked StageEntryKind = iota
+
+	// A regular file, rather than a link; most likely something copied
+	// into the stage by hand. Adopt will take it in.
+	StageForeign
+
+	// A link into this store whose blob isn't there (or whose name isn't
+	// an id at all).
+	StageBroken
+
+	// A link to a blob in some other store. Adopt will copy it into this
+	// one.
+	StageOtherStore
+
+	// A link to anything else.
+	StageExternal
+)
+
+func (k StageEntryKind) String() string {
+	switch k {
+	case StageLinked:
+		return "linked"
+	case StageForeign:
+		return "foreign"
+	case StageBroken:
+		return "broken"
+	case StageOtherStore:
+		return "other-store"
+	case StageExternal:
+		return "external"
+	}
+	return "unknown"
+}
+
+type StageEntry struct {
+	Path string
+	Kind StageEntryKind
+
+	// Where the link points, for anything that's a link.
+	Target string
+
+	// The Object the link names, for StageLinked, StageOtherStore, and
+	// StageBroken links that name one.
+	Object Object
+
+	Info os.FileInfo
+}
+
+// StageVisitor {{{
+
+func (s Store) StageVisitor(progn func(StageEntry) error) error {
+	return s.StageVisitorContext(context.Background(), progn)
+}
+
+/* Visit every file in the stage, not just links into the store as
+ * LinkedVisitor does, saying what each one is. */
+func (s Store) StageVisitorContext(ctx context.Context, progn func(StageEntry) error) error {
+	return s.stageWalk(ctx, path.Join(s.root, s.stageRoot), func(p string, info os.FileInfo) error {
+		if info.Mode().IsRegular() {
+			return progn(StageEntry{Path: p, Kind: StageForeign, Info: info})
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			/* Sockets, devices and the like; nothing to do with us. */
+			return nil
+		}
+		entry, err := s.stageLink(p, info)
+		if err != nil {
+			return err
+		}
+		return progn(entry)
+	})
+}
+
+/* Call progn for everything but directories under root, leaving out the
+ * store's own metadata, and any other store kept inside the stage; its
+ * files are its business, not ours. */
+func (s Store) stageWalk(ctx context.Context, root string, progn func(string, os.FileInfo) error) error {
+	metaRoot := path.Join(s.root, path.Dir(s.blobRoot))
+	return filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		p = path.Clean(p)
+		if info.IsDir() {
+			if p == metaRoot || (p != s.root && isStoreRoot(p, path.Base(metaRoot))) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		return progn(p, info)
+	})
+}
+
+/* Whether dir has a store's metadata directory in it. */
+func isStoreRoot(dir, meta string) bool {
+	info, err := os.Lstat(path.Join(dir, meta))
+	return err == nil && info.IsDir()
+}
+
+func (s Store) stageLink(p string, info os.FileInfo) (StageEntry, error) {
+	entry := StageEntry{Path: p, Info: info}
+	link, err := os.Readlink(p)
+	if err != nil {
+		return entry, err
+	}
+	entry.Target = link
+	if !path.IsAbs(link) {
+		link = path.Join(path.Dir(p), link)
+	}
+	obj, idErr := s.ParseObject(path.Base(link))
+	if idErr == nil {
+		entry.Object = obj
+	}
+
+	switch {
+	case s.isStorePath(link):
+		entry.Kind = StageLinked
+		if _, err := os.Stat(link); idErr != nil || err != nil {
+			entry.Kind = StageBroken
+		}
+	case idErr == nil && isOtherStorePath(link):
+		entry.Kind = StageOtherStore
+	default:
+		entry.Kind = StageExternal
+	}
+	return entry, nil
+}
+
+/* Whether p looks like where some store keeps its blobs. */
+func isOtherStorePath(p string) bool {
+	for _, dir := range []string{"/.blobs/store/", "/.blobs/raw/"} {
+		if strings.Contains(p, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// }}}
+
+// Adopt {{{
+
+func (s Store) Adopt(targetPath string) (*Object, error) {
+	return s.AdoptContext(context.Background(), targetPath)
+}
+
+/* Commit the file at targetPath (relative to the stage, like Link), and
+ * replace it with a link to its blob, just as Ingest does. It may be a
+ * regular file, or a link to another store's blob, which is copied in.
+ * Anything already linked into this store is left as it is. As with
+ * Ingest, a file whose mode isn't blobMode is refused with ErrFileMode. */
+func (s Store) AdoptContext(ctx context.Context, targetPath string) (*Object, error) {
+	stagePath := path.Clean(s.qualifyStagePath(targetPath))
+	if s.isMetaPath(stagePath) {
+		return nil, StageError{Path: stagePath, Err: errors.New("Path is inside the store")}
+	}
+	info, err := os.Lstat(stagePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		entry, err := s.stageLink(stagePath, info)
+		if err != nil {
+			return nil, err
+		}
+		switch entry.Kind {
+		case StageLinked:
+			return &entry.Object, nil
+		case StageOtherStore:
+			/* Don't take the other store's word for it. */
+			o, _, err := s.ingestFile(ctx, stagePath, true)
+			if err != nil {
+				return nil, err
+			}
+			if o != entry.Object {
+				return nil, StageError{Path: stagePath, Err: ObjectError{ID: entry.Object.Id(), Err: ErrCorrupt}}
+			}
+		case StageBroken:
+			return nil, StageError{Path: stagePath, Err: ObjectError{ID: entry.Object.Id(), Err: ErrNotFound}}
+		default:
+			return nil, StageError{Path: stagePath, Err: ErrNotALink}
+		}
+	} else if !info.Mode().IsRegular() {
+		return nil, StageError{Path: stagePath, Err: ErrNotALink}
+	}
+
+	o, _, err := s.ingestFile(ctx, stagePath, false)
+	if err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,88 @@
+package blobstore
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestStageVisitorNestedStore(t *testing.T) {
+	store := newTestStore(t)
+	nested, err := Init(path.Join(store.root, "sub/nested"), InitOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := putString(t, nested, "nested content")
+	if err := nested.Link(o, "linked"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(store.root, "sub/foreign"), []byte("ours"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	seen := map[string]StageEntryKind{}
+	err = store.StageVisitor(func(entry StageEntry) error {
+		seen[entry.Path] = entry.Kind
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 1 || seen[path.Join(store.root, "sub/foreign")] != StageForeign {
+		t.Fatalf("saw %v", seen)
+	}
+
+	result, err := store.Ingest("sub", IngestOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Files != 1 {
+		t.Fatalf("ingest would take %d files", result.Files)
+	}
+}
+
+func TestAdopt(t *testing.T) {
+	store := newTestStore(t)
+	other := newTestStore(t)
+	o := putString(t, other, "from elsewhere")
+	if err := os.Symlink(other.objToPath(o), path.Join(store.root, "borrowed")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(store.root, "plain"), []byte("plain"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(store.root, "private"), []byte("private"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := store.Adopt("borrowed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != o || !store.Exists(o) {
+		t.Fatal("borrowed blob wasn't copied in")
+	}
+	if _, err := store.Adopt("plain"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Adopt("private"); !errors.Is(err, ErrFileMode) {
+		t.Fatalf("adopting a private file gave %v", err)
+	}
+	if _, err := store.Adopt(".blobs/config.json"); err == nil {
+		t.Fatal("adopted the store's own config")
+	}
+
+	for name, link := range map[string]bool{"borrowed": true, "plain": true, "private": false} {
+		info, err := os.Lstat(path.Join(store.root, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isLink := info.Mode()&os.ModeSymlink != 0; isLink != link {
+			t.Fatalf("%s: link %t, wanted %t", name, isLink, link)
+		}
+	}
+}
+
+// vim: foldmethod=marker
@@ -0,0 +1,290 @@
+package blobstore
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+/* A bundle is a tar that carries Objects from one store to another with no
+ * network between them. The first entry is bundleIndexName, a BundleIndex
+ * listing every Object and any stage manifests; each Object follows as
+ * "objects/<id>", holding its raw (decoded) content, so the store on the
+ * other end can check it against its id and commit it however it likes. */
+const (
+	bundleVersion   = 1
+	bundleIndexName = "bundle.json"
+	bundleObjects   = "objects/"
+)
+
+type BundleIndex struct {
+	Version int      `json:"version"`
+	Objects []string `json:"objects"`
+
+	// Stage manifests, by stage path; each maps paths relative to that
+	// stage to the id linked there.
+	Stages map[string]map[string]string `json:"stages,omitempty"`
+}
+
+type BundleOptions struct {
+	// Objects to put in the bundle. If this and Stages are both empty,
+	// every Object in the store goes in.
+	Objects []Object
+
+	// Stage paths (relative to the stage, like Link) to write manifests
+	// for. Everything linked under them goes in the bundle too.
+	Stages []string
+}
+
+type ImportOptions struct {
+	// Recreate the links in the bundle's stage manifests.
+	Link bool
+}
+
+type ImportResult struct {
+	// Objects committed, and those skipped because the store already had
+	// them.
+	Imported int
+	Skipped  int
+
+	// Links recreated from stage manifests.
+	Linked int
+}
+
+// ExportBundle {{{
+
+func (s Store) ExportBundle(w io.Writer, opts BundleOptions) error {
+	return s.ExportBundleContext(context.Background(), w, opts)
+}
+
+func (s Store) ExportBundleContext(ctx context.Context, w io.Writer, opts BundleOptions) error {
+	objects, stages, err := s.bundleSelect(ctx, opts)
+	if err != nil {
+		return err
+	}
+	index := BundleIndex{Version: bundleVersion, Objects: []string{}, Stages: stages}
+	for _, o := range objects {
+		index.Objects = append(index.Objects, o.Id())
+	}
+
+	tw := tar.NewWriter(w)
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, bundleIndexName, int64(len(data))); err != nil {
+		return err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return err
+	}
+
+	for _, o := range objects {
+		size, err := s.objectSize(o)
+		if err != nil {
+			return err
+		}
+		if err := writeTarFile(tw, bundleObjects+o.Id(), size); err != nil {
+			return err
+		}
+		if _, err := s.CopyContext(ctx, o, tw); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+/* The Objects opts picks out, sorted, and the manifests of its Stages. */
+func (s Store) bundleSelect(ctx context.Context, opts BundleOptions) ([]Object, map[string]map[string]string, error) {
+	objects := map[Object]bool{}
+	for _, o := range opts.Objects {
+		objects[o] = true
+	}
+
+	var stages map[string]map[string]string
+	if len(opts.Stages) > 0 {
+		stages = map[string]map[string]string{}
+	}
+	for _, stage := range opts.Stages {
+		/* Bundles only carry Objects; anything not linked yet has to be
+		 * ingested first. */
+		entries, err := s.exportEntries(ctx, stage, false)
+		if err != nil {
+			return nil, nil, err
+		}
+		manifest := map[string]string{}
+		for _, entry := range entries {
+			manifest[entry.rel] = entry.object.Id()
+			objects[entry.object] = true
+		}
+		stages[stage] = manifest
+	}
+
+	if len(opts.Objects) == 0 && len(opts.Stages) == 0 {
+		all, err := s.ListContext(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, o := range all {
+			objects[o] = true
+		}
+	}
+
+	ret := []Object{}
+	for o := range objects {
+		ret = append(ret, o)
+	}
+	sortObjects(ret)
+	return ret, stages, nil
+}
+
+func writeTarFile(tw *tar.Writer, name string, size int64) error {
+	return tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0644,
+	})
+}
+
+// }}}
+
+// ImportBundle {{{
+
+func (s Store) ImportBundle(r io.Reader, opts ImportOptions) (ImportResult, error) {
+	return s.ImportBundleContext(context.Background(), r, opts)
+}
+
+/* Commit every Object in the bundle read from r, checking each one hashes
+ * to the id it was sent under, and that none the index lists are missing
+ * (from both the bundle and the store). Nothing is linked until all of that
+ * has checked out. */
+func (s Store) ImportBundleContext(ctx context.Context, r io.Reader, opts ImportOptions) (ImportResult, error) {
+	result := ImportResult{}
+	tr := tar.NewReader(contextReader{ctx: ctx, r: r})
+
+	header, err := tr.Next()
+	if err != nil {
+		return result, err
+	}
+	if header.Name != bundleIndexName {
+		return result, fmt.Errorf("Not a bundle: first entry is '%s', not '%s'", header.Name, bundleIndexName)
+	}
+	index := BundleIndex{}
+	if err := json.NewDecoder(tr).Decode(&index); err != nil {
+		return result, err
+	}
+	if index.Version != bundleVersion {
+		return result, fmt.Errorf("%w %d in bundle", ErrUnsupportedVersion, index.Version)
+	}
+	if opts.Link {
+		for stage, manifest := range index.Stages {
+			for rel := range manifest {
+				if err := s.checkBundlePath(stage, rel); err != nil {
+					return result, err
+				}
+			}
+		}
+	}
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return result, err
+		}
+		if header.Typeflag != tar.TypeReg || !strings.HasPrefix(header.Name, bundleObjects) {
+			continue
+		}
+		o, err := s.ParseObject(strings.TrimPrefix(header.Name, bundleObjects))
+		if err != nil {
+			return result, err
+		}
+		if s.Exists(o) {
+			result.Skipped++
+			continue
+		}
+		if err := s.importObject(o, tr); err != nil {
+			return result, err
+		}
+		result.Imported++
+	}
+
+	for _, id := range index.Objects {
+		o, err := s.ParseObject(id)
+		if err != nil {
+			return result, err
+		}
+		if !s.Exists(o) {
+			return result, ObjectError{ID: id, Err: ErrNotFound}
+		}
+	}
+
+	if !opts.Link {
+		return result, nil
+	}
+	stages := []string{}
+	for stage := range index.Stages {
+		stages = append(stages, stage)
+	}
+	sort.Strings(stages)
+	for _, stage := range stages {
+		for rel, id := range index.Stages[stage] {
+			o, err := s.ParseObject(id)
+			if err != nil {
+				return result, err
+			}
+			if err := s.Link(o, path.Join(stage, rel)); err != nil {
+				return result, err
+			}
+			result.Linked++
+		}
+	}
+	return result, nil
+}
+
+/* Don't let a bundle link anything outside the stage, or over the store's
+ * own metadata, which is in the stage too. */
+func (s Store) checkBundlePath(stage, rel string) error {
+	p := path.Join(stage, rel)
+	if !localBundlePath(stage) || !localBundlePath(rel) {
+		return StageError{Path: p, Err: errors.New("Bundle path is outside the stage")}
+	}
+	if s.isMetaPath(s.qualifyStagePath(p)) {
+		return StageError{Path: p, Err: errors.New("Bundle path is inside the store")}
+	}
+	return nil
+}
+
+func localBundlePath(p string) bool {
+	return p == path.Clean(p) && !path.IsAbs(p) && p != ".." && !strings.HasPrefix(p, "../")
+}
+
+func (s Store) importObject(o Object, r io.Reader) error {
+	w, err := s.Create()
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Abort()
+		return err
+	}
+	if w.Id() != o.Id() {
+		w.Abort()
+		return ObjectError{ID: o.Id(), Err: ErrCorrupt}
+	}
+	_, err = s.Commit(*w)
+	return err
+}
+
+// }}}
+
+// vim: foldmethod=marker
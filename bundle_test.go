@@ -0,0 +1,132 @@
+package blobstore
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestBundleRoundTrip(t *testing.T) {
+	src := newTestStore(t)
+	src.SetCodec(GzipCodec{})
+	o := putString(t, src, "bundled")
+	if err := src.Link(o, "stage/a/file"); err != nil {
+		t.Fatal(err)
+	}
+	putString(t, src, "not in the stage")
+
+	buf := bytes.Buffer{}
+	if err := src.ExportBundle(&buf, BundleOptions{Stages: []string{"stage"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := newTestStore(t)
+	result, err := dst.ImportBundle(bytes.NewReader(buf.Bytes()), ImportOptions{Link: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Imported != 1 || result.Linked != 1 {
+		t.Fatalf("imported %d, linked %d", result.Imported, result.Linked)
+	}
+	if got := readString(t, dst, o); got != "bundled" {
+		t.Fatalf("read back %q", got)
+	}
+	if _, err := os.Stat(path.Join(dst.root, "stage/a/file")); err != nil {
+		t.Fatal(err)
+	}
+
+	/* Again, and everything's already there. */
+	result, err = dst.ImportBundle(bytes.NewReader(buf.Bytes()), ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Imported != 0 || result.Skipped != 1 {
+		t.Fatalf("imported %d, skipped %d", result.Imported, result.Skipped)
+	}
+}
+
+/* A bundle written by hand, with objects given as id to content. */
+func hostileBundle(t *testing.T, index BundleIndex, objects map[string]string) *bytes.Reader {
+	t.Helper()
+	buf := bytes.Buffer{}
+	tw := tar.NewWriter(&buf)
+	data, err := json.Marshal(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeTarFile(tw, bundleIndexName, int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	tw.Write(data)
+	for id, content := range objects {
+		if err := writeTarFile(tw, bundleObjects+id, int64(len(content))); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(content))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return bytes.NewReader(buf.Bytes())
+}
+
+func TestBundleHostile(t *testing.T) {
+	src := newTestStore(t)
+	o := putString(t, src, "payload")
+
+	for name, stages := range map[string]map[string]map[string]string{
+		"escape":       {"stage": {"../../escape": o.Id()}},
+		"absolute":     {"/tmp": {"escape": o.Id()}},
+		"meta stage":   {".blobs": {"store/x": o.Id()}},
+		"meta rel":     {"": {".blobs/config.json": o.Id()}},
+		"meta root":    {".": {".blobs": o.Id()}},
+		"meta unclean": {"stage/../.blobs": {"new": o.Id()}},
+	} {
+		dst := newTestStore(t)
+		config, err := ioutil.ReadFile(path.Join(dst.root, configPath))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = dst.ImportBundle(hostileBundle(t, BundleIndex{
+			Version: bundleVersion,
+			Objects: []string{o.Id()},
+			Stages:  stages,
+		}, map[string]string{o.Id(): "payload"}), ImportOptions{Link: true})
+		if err == nil {
+			t.Fatalf("%s: hostile manifest imported", name)
+		}
+		after, err := ioutil.ReadFile(path.Join(dst.root, configPath))
+		if err != nil || !bytes.Equal(config, after) {
+			t.Fatalf("%s: store config touched: %v", name, err)
+		}
+	}
+
+	/* Content that doesn't hash to the id it came under. */
+	dst := newTestStore(t)
+	_, err := dst.ImportBundle(hostileBundle(t, BundleIndex{
+		Version: bundleVersion,
+		Objects: []string{o.Id()},
+	}, map[string]string{o.Id(): "an impostor"}), ImportOptions{})
+	if !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("impostor object gave %v", err)
+	}
+	if dst.Exists(o) {
+		t.Fatal("impostor object committed")
+	}
+
+	/* An index listing an object the bundle doesn't carry. */
+	_, err = dst.ImportBundle(hostileBundle(t, BundleIndex{
+		Version: bundleVersion,
+		Objects: []string{o.Id()},
+	}, nil), ImportOptions{})
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("missing object gave %v", err)
+	}
+}
+
+// vim: foldmethod=marker
@@ -0,0 +1,402 @@
+package blobstore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+/* CARv1 (https://ipld.io/specs/transport/car/carv1/) is a varint length
+ * prefixed DAG-CBOR header, {"roots": [CID...], "version": 1}, followed by
+ * a varint length prefixed CID and block for each block.
+ *
+ * Every Object goes in as a single raw block, so its CID is just a CIDv1
+ * with the raw codec and a sha2-256 multihash of the id we already have;
+ * the mapping is fixed, and needs nothing but the id. There's no DAG to
+ * speak of, so every Object is also a root.
+ *
+ * IPFS nodes tend to refuse blocks over a MiB or two, so anything bigger
+ * may need chunking on the other end. Stores with keyed object ids
+ * (SetObjectIDKey) can't take part at all, since their ids aren't the
+ * sha2-256 of anything. */
+const (
+	cidVersion1     = 0x01
+	cidCodecRaw     = 0x55
+	multihashSHA256 = 0x12
+	carVersion      = 1
+
+	// Every Object is a root, at a little over 40 bytes each, so this is
+	// room for over a million of them.
+	maxCARHeader = 64 << 20
+	maxCBORDepth = 16
+)
+
+var cidBase32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// CID {{{
+
+/* The CIDv1 of o as a raw block, in the usual base32 string form
+ * ("bafkrei..."). */
+func CID(o Object) (string, error) {
+	cid, err := cidBytes(o)
+	if err != nil {
+		return "", err
+	}
+	return "b" + strings.ToLower(cidBase32.EncodeToString(cid)), nil
+}
+
+/* The Object a raw sha2-256 CIDv1, as returned by CID, refers to. */
+func ParseCID(cid string) (Object, error) {
+	if !strings.HasPrefix(cid, "b") {
+		return Object{}, InvalidIDError{ID: cid, Reason: "not a base32 CIDv1"}
+	}
+	data, err := cidBase32.DecodeString(strings.ToUpper(cid[1:]))
+	if err != nil {
+		return Object{}, InvalidIDError{ID: cid, Reason: "not a base32 CIDv1"}
+	}
+	o, n, err := parseCIDBytes(data)
+	if err != nil {
+		return Object{}, err
+	}
+	if n != len(data) {
+		return Object{}, InvalidIDError{ID: cid, Reason: "trailing bytes after CID"}
+	}
+	return o, nil
+}
+
+func cidBytes(o Object) ([]byte, error) {
+	digest, err := hex.DecodeString(o.Id())
+	if err != nil || len(digest) != sha256.Size {
+		return nil, InvalidIDError{ID: o.Id(), Reason: "not a sha256 id"}
+	}
+	cid := []byte{cidVersion1, cidCodecRaw, multihashSHA256, sha256.Size}
+	return append(cid, digest...), nil
+}
+
+/* Parse the binary CID at the start of data, returning how long it was. */
+func parseCIDBytes(data []byte) (Object, int, error) {
+	r := bytes.NewReader(data)
+	fields := [4]uint64{}
+	for i := range fields {
+		v, err := binary.ReadUvarint(r)
+		if err != nil {
+			return Object{}, 0, InvalidIDError{ID: hex.EncodeToString(data), Reason: "truncated CID"}
+		}
+		fields[i] = v
+	}
+	version, codec, hashCode, length := fields[0], fields[1], fields[2], fields[3]
+	id := hex.EncodeToString(data)
+
+	switch {
+	case version != cidVersion1:
+		return Object{}, 0, InvalidIDError{ID: id, Reason: fmt.Sprintf("CID version %d, not 1", version)}
+	case codec != cidCodecRaw:
+		return Object{}, 0, InvalidIDError{ID: id, Reason: fmt.Sprintf("CID codec 0x%x, not raw", codec)}
+	case hashCode != multihashSHA256 || length != sha256.Size:
+		return Object{}, 0, InvalidIDError{ID: id, Reason: "CID hash is not sha2-256"}
+	}
+	digest := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(r, digest); err != nil {
+		return Object{}, 0, InvalidIDError{ID: id, Reason: "truncated CID"}
+	}
+	o, err := ParseObject(hex.EncodeToString(digest))
+	return o, len(data) - r.Len(), err
+}
+
+// }}}
+
+// ExportCAR {{{
+
+func (s Store) ExportCAR(w io.Writer, opts BundleOptions) error {
+	return s.ExportCARContext(context.Background(), w, opts)
+}
+
+/* Write the Objects opts picks out (just as for ExportBundle, but without
+ * stage manifests, which CAR has no room for) to w as a CARv1. */
+func (s Store) ExportCARContext(ctx context.Context, w io.Writer, opts BundleOptions) error {
+	objects, _, err := s.bundleSelect(ctx, opts)
+	if err != nil {
+		return err
+	}
+	cids := [][]byte{}
+	for _, o := range objects {
+		cid, err := cidBytes(o)
+		if err != nil {
+			return err
+		}
+		cids = append(cids, cid)
+	}
+
+	header := carHeader(cids)
+	if len(header) > maxCARHeader {
+		return fmt.Errorf("Too many objects for one CAR: %d", len(objects))
+	}
+	bw := bufio.NewWriter(w)
+	if err := writeCARSection(bw, header); err != nil {
+		return err
+	}
+	for i, o := range objects {
+		size, err := s.objectSize(o)
+		if err != nil {
+			return err
+		}
+		if err := writeUvarint(bw, uint64(len(cids[i]))+uint64(size)); err != nil {
+			return err
+		}
+		if _, err := bw.Write(cids[i]); err != nil {
+			return err
+		}
+
+		/* The CID promises the block hashes to the id, so make sure it
+		 * does before we hand it over. */
+		hash := sha256.New()
+		n, err := s.CopyContext(ctx, o, io.MultiWriter(bw, hash))
+		if err != nil {
+			return err
+		}
+		if n != size || hex.EncodeToString(hash.Sum(nil)) != o.Id() {
+			return ObjectError{ID: o.Id(), Err: ErrCorrupt}
+		}
+	}
+	return bw.Flush()
+}
+
+/* DAG-CBOR for {"roots": [cids...], "version": 1}; keys in DAG-CBOR's
+ * length-first order, and CIDs as tag 42 byte strings with a leading 0. */
+func carHeader(cids [][]byte) []byte {
+	buf := &bytes.Buffer{}
+	buf.Write(cborHead(5, 2))
+	buf.Write(cborHead(3, 5))
+	buf.WriteString("roots")
+	buf.Write(cborHead(4, uint64(len(cids))))
+	for _, cid := range cids {
+		buf.Write(cborHead(6, 42))
+		buf.Write(cborHead(2, uint64(len(cid)+1)))
+		buf.WriteByte(0)
+		buf.Write(cid)
+	}
+	buf.Write(cborHead(3, 7))
+	buf.WriteString("version")
+	buf.Write(cborHead(0, carVersion))
+	return buf.Bytes()
+}
+
+func cborHead(major byte, n uint64) []byte {
+	major <<= 5
+	switch {
+	case n < 24:
+		return []byte{major | byte(n)}
+	case n <= 0xff:
+		return []byte{major | 24, byte(n)}
+	case n <= 0xffff:
+		b := []byte{major | 25, 0, 0}
+		binary.BigEndian.PutUint16(b[1:], uint16(n))
+		return b
+	case n <= 0xffffffff:
+		b := []byte{major | 26, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(b[1:], uint32(n))
+		return b
+	default:
+		b := []byte{major | 27, 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint64(b[1:], n)
+		return b
+	}
+}
+
+func writeUvarint(w io.Writer, n uint64) error {
+	buf := make([]byte, binary.MaxVarintLen64)
+	_, err := w.Write(buf[:binary.PutUvarint(buf, n)])
+	return err
+}
+
+func writeCARSection(w io.Writer, data []byte) error {
+	if err := writeUvarint(w, uint64(len(data))); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// }}}
+
+// ImportCAR {{{
+
+func (s Store) ImportCAR(r io.Reader) (ImportResult, error) {
+	return s.ImportCARContext(context.Background(), r)
+}
+
+/* Commit every block of the CARv1 read from r, checking each hashes to its
+ * CID. Only raw sha2-256 CIDv1 blocks are taken; anything else is an
+ * error, since its CID couldn't be got back from its Object. */
+func (s Store) ImportCARContext(ctx context.Context, r io.Reader) (ImportResult, error) {
+	result := ImportResult{}
+	br := bufio.NewReader(contextReader{ctx: ctx, r: r})
+
+	headerLength, err := binary.ReadUvarint(br)
+	if err != nil {
+		return result, err
+	}
+	if headerLength > maxCARHeader {
+		return result, errors.New("CAR header is too large")
+	}
+	/* Read it as it comes, rather than trusting the length enough to
+	 * allocate it all up front. */
+	header, err := ioutil.ReadAll(io.LimitReader(br, int64(headerLength)))
+	if err != nil {
+		return result, err
+	}
+	if uint64(len(header)) != headerLength {
+		return result, io.ErrUnexpectedEOF
+	}
+	version, err := carHeaderVersion(header)
+	if err != nil {
+		return result, err
+	}
+	if version != carVersion {
+		return result, fmt.Errorf("%w %d in CAR", ErrUnsupportedVersion, version)
+	}
+
+	for {
+		length, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			return result, nil
+		}
+		if err != nil {
+			return result, err
+		}
+
+		/* Plenty for any CID we'd accept. */
+		prefix, err := br.Peek(64)
+		if err != nil && err != io.EOF {
+			return result, err
+		}
+		o, n, err := parseCIDBytes(prefix)
+		if err != nil {
+			return result, err
+		}
+		if uint64(n) > length {
+			return result, io.ErrUnexpectedEOF
+		}
+		if _, err := br.Discard(n); err != nil {
+			return result, err
+		}
+
+		block := io.LimitReader(br, int64(length)-int64(n))
+		if s.Exists(o) {
+			if _, err := io.Copy(io.Discard, block); err != nil {
+				return result, err
+			}
+			result.Skipped++
+			continue
+		}
+		if err := s.importObject(o, block); err != nil {
+			return result, err
+		}
+		result.Imported++
+	}
+}
+
+/* Pull "version" out of a DAG-CBOR CAR header, skipping anything else. */
+func carHeaderVersion(header []byte) (uint64, error) {
+	r := bytes.NewReader(header)
+	major, n, err := readCBORHead(r)
+	if err != nil {
+		return 0, err
+	}
+	if major != 5 {
+		return 0, errors.New("CAR header is not a map")
+	}
+	for i := uint64(0); i < n; i++ {
+		major, length, err := readCBORHead(r)
+		if err != nil {
+			return 0, err
+		}
+		if major != 3 || length > uint64(r.Len()) {
+			return 0, errors.New("CAR header has a key that isn't a string")
+		}
+		key := make([]byte, length)
+		r.Read(key)
+		if string(key) != "version" {
+			if err := skipCBOR(r, 0); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		major, version, err := readCBORHead(r)
+		if err != nil {
+			return 0, err
+		}
+		if major != 0 {
+			return 0, errors.New("CAR header version is not a number")
+		}
+		return version, nil
+	}
+	return 0, errors.New("CAR header has no version")
+}
+
+func readCBORHead(r *bytes.Reader) (byte, uint64, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, io.ErrUnexpectedEOF
+	}
+	major, info := b>>5, b&0x1f
+	if info < 24 {
+		return major, uint64(info), nil
+	}
+	if info > 27 {
+		return 0, 0, errors.New("Unsupported CBOR in CAR header")
+	}
+	buf := make([]byte, 1<<(info-24))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, 0, io.ErrUnexpectedEOF
+	}
+	n := uint64(0)
+	for _, c := range buf {
+		n = n<<8 | uint64(c)
+	}
+	return major, n, nil
+}
+
+/* Skip over the next CBOR item in r, which is nested depth deep. */
+func skipCBOR(r *bytes.Reader, depth int) error {
+	if depth > maxCBORDepth {
+		return errors.New("CAR header is nested too deeply")
+	}
+	major, n, err := readCBORHead(r)
+	if err != nil {
+		return err
+	}
+	switch major {
+	case 2, 3:
+		if n > uint64(r.Len()) {
+			return io.ErrUnexpectedEOF
+		}
+		_, err := r.Seek(int64(n), io.SeekCurrent)
+		return err
+	case 4, 5:
+		if major == 5 {
+			n *= 2
+		}
+		for i := uint64(0); i < n; i++ {
+			if err := skipCBOR(r, depth+1); err != nil {
+				return err
+			}
+		}
+	case 6:
+		return skipCBOR(r, depth+1)
+	}
+	return nil
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,100 @@
+package blobstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCARRoundTrip(t *testing.T) {
+	src := newTestStore(t)
+	src.SetCodec(GzipCodec{})
+	objects := []Object{
+		putString(t, src, "block one"),
+		putString(t, src, "block two"),
+	}
+
+	buf := bytes.Buffer{}
+	if err := src.ExportCAR(&buf, BundleOptions{Objects: objects}); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := newTestStore(t)
+	result, err := dst.ImportCAR(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Imported != 2 {
+		t.Fatalf("imported %d", result.Imported)
+	}
+	for _, o := range objects {
+		if readString(t, dst, o) != readString(t, src, o) {
+			t.Fatalf("%s didn't round trip", o.Id())
+		}
+	}
+
+	cid, err := CID(objects[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if back, err := ParseCID(cid); err != nil || back != objects[0] {
+		t.Fatalf("CID %s parsed back as %v, %v", cid, back, err)
+	}
+}
+
+/* A CAR of the given blocks, each written under the CID of o. */
+func hostileCAR(t *testing.T, o Object, block []byte) []byte {
+	t.Helper()
+	cid, err := cidBytes(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.Buffer{}
+	if err := writeCARSection(&buf, carHeader([][]byte{cid})); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeCARSection(&buf, append(append([]byte{}, cid...), block...)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestCARHostile(t *testing.T) {
+	src := newTestStore(t)
+	o := putString(t, src, "the real block")
+
+	dst := newTestStore(t)
+	if _, err := dst.ImportCAR(bytes.NewReader(hostileCAR(t, o, []byte("an impostor")))); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("impostor block gave %v", err)
+	}
+	if dst.Exists(o) {
+		t.Fatal("impostor block committed")
+	}
+
+	/* {"x": 0(0(0(...)))}, nested far deeper than any real header. */
+	deepHeader := append([]byte{0xa1, 0x61, 'x'}, bytes.Repeat([]byte{0xc0}, 100000)...)
+	deepHeader = append(deepHeader, 0)
+	if _, err := carHeaderVersion(deepHeader); err == nil || !strings.Contains(err.Error(), "nested too deeply") {
+		t.Fatalf("deep header gave %v", err)
+	}
+	deep := append(binary.AppendUvarint(nil, uint64(len(deepHeader))), deepHeader...)
+
+	good := hostileCAR(t, o, []byte("the real block"))
+	for name, data := range map[string][]byte{
+		"deep header": deep,
+		"long header": binary.AppendUvarint(nil, maxCARHeader),
+		"truncated":   good[:len(good)-4],
+		"no header":   {},
+		"huge header": {0xff, 0xff, 0xff, 0xff, 0x0f},
+		"bad header":  append([]byte{3}, 0xa1, 0x61, 0x76),
+		"bad cid":     append(append([]byte{}, good[:len(good)-len("the real block")-36]...), bytes.Repeat([]byte{0xff}, 50)...),
+	} {
+		if _, err := newTestStore(t).ImportCAR(bytes.NewReader(data)); err == nil {
+			t.Fatalf("%s: imported", name)
+		}
+	}
+}
+
+// vim: foldmethod=marker
@@ -0,0 +1,428 @@
+package blobstore
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+/* A chunked blob is split into content-defined chunks, each of which is
+ * committed as a blob of its own, and the blob itself is stored as a
+ * recipe: a recipeCodecName codec header followed by one "<id> <size>"
+ * line per chunk, in order. Since chunk boundaries depend only on the
+ * content around them, two mostly identical files share most of their
+ * chunks.
+ *
+ * Chunk boundaries are found with a gear rolling hash, in the style of
+ * FastCDC.
+ *
+ * A link has to point at a file with the whole content in it, so linking a
+ * chunked blob means a full copy of it; see SetLinkCopies. */
+const recipeCodecName = "chunked"
+
+type ChunkOptions struct {
+	// Chunks are never smaller than Min bytes (save for the last one),
+	// never larger than Max, and Avg bytes on average. Avg is rounded
+	// down to a power of two.
+	Min int
+	Avg int
+	Max int
+}
+
+var DefaultChunkOptions = ChunkOptions{
+	Min: 16 * 1024,
+	Avg: 64 * 1024,
+	Max: 256 * 1024,
+}
+
+type Chunk struct {
+	Object Object
+	Size   int64
+}
+
+var gearTable [256]uint64
+
+func init() {
+	/* splitmix64, from a fixed seed; the table has to be the same
+	 * everywhere, or chunk boundaries (and so dedup) won't line up. */
+	x := uint64(0x626c6f6273746f72)
+	for i := range gearTable {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gearTable[i] = z ^ (z >> 31)
+	}
+}
+
+// CreateChunked {{{
+
+func (s Store) CreateChunked(opts ChunkOptions) (*Writer, error) {
+	if opts.Min <= 0 || opts.Avg < opts.Min || opts.Max < opts.Avg {
+		return nil, fmt.Errorf("Invalid chunk sizes: %d/%d/%d", opts.Min, opts.Avg, opts.Max)
+	}
+
+	dir := path.Join(s.root, s.tempRoot)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	fd, err := ioutil.TempFile(dir, "recipe")
+	if err != nil {
+		return nil, err
+	}
+	hashWriter := s.objectIDHasher()
+	written := new(int64)
+
+	mask := uint64(1)
+	for mask<<1 <= uint64(opts.Avg) {
+		mask <<= 1
+	}
+
+	c := &chunker{store: s, opts: opts, mask: mask - 1}
+	w := &Writer{
+		path:    fd.Name(),
+		writer:  fd,
+		chunker: c,
+		target:  io.MultiWriter(c, hashWriter, countingWriter{written}),
+		hash:    hashWriter,
+		written: written,
+	}
+	if s.keys != nil {
+		/* The chunks go through Create, and get encrypted there; the
+		 * recipe has to be too, or anyone could read the list of them. */
+		ew, sizeAt, err := s.newEncrypter(fd)
+		if err != nil {
+			fd.Close()
+			os.Remove(fd.Name())
+			return nil, err
+		}
+		w.encoder, w.sizeAt = ew, sizeAt
+	}
+	return w, nil
+}
+
+// }}}
+
+// Recipe {{{
+
+/* Return the chunks that make up o, or nil if o isn't a chunked blob. */
+func (s Store) Recipe(o Object) ([]Chunk, error) {
+	if err := s.validObject(o); err != nil {
+		return nil, err
+	}
+	fd, err := s.openRaw(o)
+	if err != nil {
+		return nil, s.objectError(o, err)
+	}
+	defer fd.Close()
+
+	name, r, err := s.innerCodecHeader(o, fd)
+	if err != nil || name != recipeCodecName {
+		return nil, err
+	}
+	return s.readRecipe(r)
+}
+
+/* Write the recipe of o, which is made of chunks, back out with the
+ * store's current key, in place of the old one. */
+func (s Store) rewriteRecipe(o Object, chunks []Chunk) error {
+	dir := path.Join(s.root, s.tempRoot)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	fd, err := ioutil.TempFile(dir, "recipe")
+	if err != nil {
+		return err
+	}
+	abort := func(err error) error {
+		fd.Close()
+		os.Remove(fd.Name())
+		return err
+	}
+
+	var (
+		w      io.WriteCloser = nopWriteCloser{fd}
+		sizeAt int64
+	)
+	if s.keys != nil {
+		if w, sizeAt, err = s.newEncrypter(fd); err != nil {
+			return abort(err)
+		}
+	}
+	if err := s.writeRecipe(w, chunks, s.keys == nil); err != nil {
+		return abort(err)
+	}
+	if err := w.Close(); err != nil {
+		return abort(err)
+	}
+	if err := fd.Close(); err != nil {
+		os.Remove(fd.Name())
+		return err
+	}
+	if sizeAt > 0 {
+		if err := patchCodecSize(fd.Name(), sizeAt, recipeSize(chunks)); err != nil {
+			os.Remove(fd.Name())
+			return err
+		}
+	}
+	if err := s.commitFile(fd.Name(), o); err != nil {
+		os.Remove(fd.Name())
+		return err
+	}
+	return nil
+}
+
+// }}}
+
+// ChunkStats {{{
+
+type ChunkStats struct {
+	// Number of chunked blobs.
+	Recipes int
+
+	// Sum of the sizes of every chunked blob.
+	LogicalBytes int64
+
+	// Number of distinct chunks those blobs reference, and the sum of
+	// their (uncompressed) sizes.
+	UniqueChunks int
+	UniqueBytes  int64
+}
+
+func (c ChunkStats) DedupRatio() float64 {
+	if c.UniqueBytes == 0 {
+		return 1
+	}
+	return float64(c.LogicalBytes) / float64(c.UniqueBytes)
+}
+
+func (s Store) ChunkStats(ctx context.Context) (ChunkStats, error) {
+	stats := ChunkStats{}
+	seen := map[Object]bool{}
+	err := s.ListVisitorContext(ctx, ListOptions{}, func(o Object) error {
+		chunks, err := s.Recipe(o)
+		if err != nil || chunks == nil {
+			return err
+		}
+		stats.Recipes++
+		for _, chunk := range chunks {
+			stats.LogicalBytes += chunk.Size
+			if !seen[chunk.Object] {
+				seen[chunk.Object] = true
+				stats.UniqueChunks++
+				stats.UniqueBytes += chunk.Size
+			}
+		}
+		return nil
+	})
+	return stats, err
+}
+
+// }}}
+
+// chunker {{{
+
+type chunker struct {
+	store  Store
+	opts   ChunkOptions
+	mask   uint64
+	fp     uint64
+	buf    []byte
+	chunks []Chunk
+
+	// Chunks flush pinned, which nothing else would keep from GC until
+	// the recipe that needs them is committed.
+	pinned []Object
+}
+
+func (c *chunker) Write(b []byte) (int, error) {
+	for _, el := range b {
+		c.buf = append(c.buf, el)
+		c.fp = (c.fp << 1) + gearTable[el]
+		if len(c.buf) < c.opts.Min {
+			continue
+		}
+		if c.fp&c.mask == 0 || len(c.buf) >= c.opts.Max {
+			if err := c.flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return len(b), nil
+}
+
+func (c *chunker) flush() error {
+	if len(c.buf) == 0 {
+		return nil
+	}
+	w, err := c.store.Create()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(c.buf); err != nil {
+		w.Abort()
+		return err
+	}
+	obj := Object{id: w.Id()}
+	/* Someone else's pin is left to them; we'd only drop it later. */
+	if !c.store.isPinned(obj) {
+		if err := c.store.Pin(obj); err != nil {
+			w.Abort()
+			return err
+		}
+		c.pinned = append(c.pinned, obj)
+	}
+	if _, err := c.store.Commit(*w); err != nil {
+		return err
+	}
+	c.chunks = append(c.chunks, Chunk{Object: obj, Size: int64(len(c.buf))})
+	c.buf = c.buf[:0]
+	c.fp = 0
+	return nil
+}
+
+/* Drop the pins flush took, once the recipe is committed or given up on. */
+func (c *chunker) unpin() error {
+	for _, o := range c.pinned {
+		if err := c.store.Unpin(o); err != nil {
+			return err
+		}
+	}
+	c.pinned = nil
+	return nil
+}
+
+/* Make sure every chunk is still there before the recipe is committed;
+ * pins keep GC away, but not a Remove. */
+func (c *chunker) check() error {
+	for _, chunk := range c.chunks {
+		if !c.store.Exists(chunk.Object) {
+			return ObjectError{ID: chunk.Object.Id(), Err: ErrNotFound}
+		}
+	}
+	return nil
+}
+
+/* Write the recipe out to w; outer says whether it's the start of the
+ * blob, rather than inside of encryption. */
+func (c *chunker) writeRecipe(w io.Writer, outer bool) error {
+	if err := c.flush(); err != nil {
+		return err
+	}
+	return c.store.writeRecipe(w, c.chunks, outer)
+}
+
+func (s Store) writeRecipe(w io.Writer, chunks []Chunk, outer bool) error {
+	var err error
+	if outer {
+		_, err = s.writeOuterCodecHeader(w, recipeCodec{}, recipeSize(chunks))
+	} else {
+		err = writeCodecHeader(w, recipeCodec{})
+	}
+	if err != nil {
+		return err
+	}
+	for _, chunk := range chunks {
+		if _, err := fmt.Fprintf(w, "%s %d\n", chunk.Object.Id(), chunk.Size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* recipeCodec only exists to give writeCodecHeader a name; reading a
+ * recipe needs the Store, so it's never registered. */
+type recipeCodec struct{ IdentityCodec }
+
+func (recipeCodec) Name() string {
+	return recipeCodecName
+}
+
+// }}}
+
+// recipe helpers {{{
+
+func recipeSize(chunks []Chunk) int64 {
+	size := int64(0)
+	for _, chunk := range chunks {
+		size += chunk.Size
+	}
+	return size
+}
+
+func (s Store) readRecipe(r *bufio.Reader) ([]Chunk, error) {
+	chunks := []Chunk{}
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return chunks, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, ErrCorrupt
+		}
+		obj, err := s.ParseObject(fields[0])
+		if err != nil {
+			return nil, ErrCorrupt
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, ErrCorrupt
+		}
+		chunks = append(chunks, Chunk{Object: obj, Size: size})
+	}
+}
+
+type recipeReader struct {
+	store   Store
+	chunks  []Chunk
+	current io.ReadCloser
+}
+
+func (r *recipeReader) Read(b []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.chunks) == 0 {
+				return 0, io.EOF
+			}
+			rc, err := r.store.Open(r.chunks[0].Object)
+			if err != nil {
+				return 0, err
+			}
+			r.current = rc
+			r.chunks = r.chunks[1:]
+		}
+		n, err := r.current.Read(b)
+		if err == io.EOF {
+			if cerr := r.current.Close(); cerr != nil {
+				return n, cerr
+			}
+			r.current = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (r *recipeReader) Close() error {
+	if r.current == nil {
+		return nil
+	}
+	return r.current.Close()
+}
+
+// }}}
+
+// vim: foldmethod=marker
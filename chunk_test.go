@@ -0,0 +1,189 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+)
+
+func putChunked(t *testing.T, store *Store, content []byte) Object {
+	t.Helper()
+	w, err := store.CreateChunked(ChunkOptions{Min: 2048, Avg: 8192, Max: 32768})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	o, err := store.Commit(*w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *o
+}
+
+func TestChunkDedup(t *testing.T) {
+	store := newTestStore(t)
+	a := make([]byte, 1024*1024)
+	rand.New(rand.NewSource(3)).Read(a)
+
+	/* The same, with a little inserted near the front. */
+	b := append(append(append([]byte{}, a[:1000]...), []byte("something new")...), a[1000:]...)
+
+	oa := putChunked(t, store, a)
+	ob := putChunked(t, store, b)
+	if got := readString(t, store, ob); got != string(b) {
+		t.Fatal("chunked content didn't round trip")
+	}
+
+	stats, err := store.ChunkStats(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Recipes != 2 || stats.LogicalBytes != int64(len(a)+len(b)) {
+		t.Fatalf("%+v", stats)
+	}
+	if stats.DedupRatio() < 1.8 {
+		t.Fatalf("dedup ratio of %f for near identical files", stats.DedupRatio())
+	}
+
+	ca, _ := store.Recipe(oa)
+	cb, _ := store.Recipe(ob)
+	if ca[len(ca)-1] != cb[len(cb)-1] {
+		t.Fatal("last chunks differ")
+	}
+}
+
+func TestChunkLink(t *testing.T) {
+	store := newTestStore(t)
+	content := make([]byte, 256*1024)
+	rand.New(rand.NewSource(4)).Read(content)
+	o := putChunked(t, store, content)
+
+	if err := store.Link(o, "big"); !errors.Is(err, ErrNeedsCopy) {
+		t.Fatalf("linking a chunked object: %v", err)
+	}
+	if _, err := os.Stat(path.Join(store.root, store.rawRoot)); !os.IsNotExist(err) {
+		t.Fatalf("raw copy made anyway: %v", err)
+	}
+
+	store.SetLinkCopies(true)
+	if err := store.Link(o, "big"); err != nil {
+		t.Fatal(err)
+	}
+	rc, err := store.OpenPath("big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	buf := bytes.Buffer{}
+	buf.ReadFrom(rc)
+	if !bytes.Equal(buf.Bytes(), content) {
+		t.Fatal("linked copy differs")
+	}
+}
+
+func TestChunkGC(t *testing.T) {
+	store := newTestStore(t)
+	store.SetLinkCopies(true)
+	content := make([]byte, 256*1024)
+	rand.New(rand.NewSource(5)).Read(content)
+	o := putChunked(t, store, content)
+	chunks, err := store.Recipe(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Link(o, "big"); err != nil {
+		t.Fatal(err)
+	}
+	junk := putString(t, store, "junk")
+
+	if err := store.GC(DumbGarbageCollector{}); err != nil {
+		t.Fatal(err)
+	}
+	if store.Exists(junk) {
+		t.Fatal("unlinked object survived GC")
+	}
+	for _, chunk := range chunks {
+		if !store.Exists(chunk.Object) {
+			t.Fatal("GC removed a chunk of a linked object")
+		}
+	}
+
+	if err := store.Unlink("big"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.GC(DumbGarbageCollector{}); err != nil {
+		t.Fatal(err)
+	}
+	objects, err := store.List()
+	if err != nil || len(objects) != 0 {
+		t.Fatalf("%d objects left after GC, %v", len(objects), err)
+	}
+}
+
+/* Chunks are committed as they're written, long before the recipe that
+ * keeps them live; a GC in between mustn't take them. */
+func TestChunkGCMidWrite(t *testing.T) {
+	store := newTestStore(t)
+	content := make([]byte, 256*1024)
+	rand.New(rand.NewSource(6)).Read(content)
+
+	w, err := store.CreateChunked(ChunkOptions{Min: 2048, Avg: 8192, Max: 32768})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(content[:128*1024]); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.GC(DumbGarbageCollector{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(content[128*1024:]); err != nil {
+		t.Fatal(err)
+	}
+	o, err := store.Commit(*w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readString(t, store, *o); got != string(content) {
+		t.Fatal("chunked object didn't survive a GC part way through")
+	}
+	if pinned, err := store.Pinned(); err != nil || len(pinned) != 0 {
+		t.Fatalf("%d pins left after Commit, %v", len(pinned), err)
+	}
+}
+
+/* A chunk Removed part way through can't be kept, but Commit must notice
+ * rather than write a recipe that points at nothing. */
+func TestChunkRemovedMidWrite(t *testing.T) {
+	store := newTestStore(t)
+	content := make([]byte, 256*1024)
+	rand.New(rand.NewSource(7)).Read(content)
+
+	w, err := store.CreateChunked(ChunkOptions{Min: 2048, Avg: 8192, Max: 32768})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.chunker.chunks) == 0 {
+		t.Fatal("nothing was chunked")
+	}
+	if err := store.Remove(w.chunker.chunks[0].Object); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Commit(*w); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("committing with a chunk missing: %v", err)
+	}
+	if pinned, err := store.Pinned(); err != nil || len(pinned) != 0 {
+		t.Fatalf("%d pins left after a failed Commit, %v", len(pinned), err)
+	}
+}
+
+// vim: foldmethod=marker
@@ -0,0 +1,671 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"pault.ag/go/blobstore"
+)
+
+type command struct {
+	usage string
+	run   func(ctx context.Context, store *blobstore.Store, args []string) error
+}
+
+var commands = map[string]command{
+	"init":    {"[--codec name] [--index] [--shard layout]", cmdInit},
+	"migrate": {"", cmdMigrate},
+	"reshard": {"<layout>", cmdReshard},
+	"put":     {"<file|->", cmdPut},
+	"ingest":  {"[--dry-run] [--workers n] <dir>", cmdIngest},
+	"cat":     {"<id>", cmdCat},
+	"link":    {"<id> <path>", cmdLink},
+	"export":  {"<stage> <dest> | --tar <stage>", cmdExport},
+	"bundle":  {"[--car] [--stage path]... [id...]", cmdBundle},
+	"import":  {"[--car] [--link] <bundle|->", cmdImport},
+	"ls":      {"[prefix]", cmdLs},
+	"linked":  {"", cmdLinked},
+	"paths":   {"", cmdPaths},
+	"check":   {"[--adopt]", cmdCheck},
+	"gc":      {"[--dry-run]", cmdGC},
+	"rm":      {"<id>...", cmdRm},
+	"fsck":    {"", cmdFsck},
+	"stat":    {"<id>", cmdStat},
+}
+
+/* Commands that make or upgrade the store themselves, rather than work on
+ * one that's loaded for them. */
+var storeless = map[string]bool{"init": true, "migrate": true}
+
+var (
+	root       = flag.String("root", ".", "path to the store")
+	jsonOutput = flag.Bool("json", false, "write output as JSON")
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s [flags] <command> [args]\n\nflags:\n", os.Args[0])
+	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\ncommands:\n")
+	names := []string{}
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s %s\n", name, commands[name].usage)
+	}
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command: '%s'\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+
+	var store *blobstore.Store
+	if !storeless[flag.Arg(0)] {
+		var err error
+		if store, err = blobstore.Load(*root); err != nil {
+			fail(err)
+		}
+	}
+	if err := cmd.run(context.Background(), store, flag.Args()[1:]); err != nil {
+		fail(err)
+	}
+}
+
+// output helpers {{{
+
+func fail(err error) {
+	if *jsonOutput {
+		json.NewEncoder(os.Stderr).Encode(map[string]string{"error": err.Error()})
+	} else {
+		fmt.Fprintf(os.Stderr, "blobstore: %s\n", err)
+	}
+	os.Exit(1)
+}
+
+/* Write v as JSON if we were asked to, otherwise call text to write it out
+ * for humans. */
+func output(v interface{}, text func()) error {
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	text()
+	return nil
+}
+
+func needArgs(args []string, n int, usage string) error {
+	if len(args) < n {
+		return fmt.Errorf("Not enough arguments, expected %s", usage)
+	}
+	return nil
+}
+
+func ids(objects []blobstore.Object) []string {
+	ret := []string{}
+	for _, o := range objects {
+		ret = append(ret, o.Id())
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// }}}
+
+// init {{{
+
+func cmdInit(ctx context.Context, store *blobstore.Store, args []string) error {
+	flags := flag.NewFlagSet("init", flag.ContinueOnError)
+	codec := flags.String("codec", "", "codec to commit new blobs with")
+	index := flags.Bool("index", false, "keep a reverse index of stage links")
+	shard := flags.String("shard", "1/1/4", "shard layout, such as 2/2, or flat")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	layout, err := blobstore.ParseShardLayout(*shard)
+	if err != nil {
+		return err
+	}
+
+	path, err := filepath.Abs(*root)
+	if err != nil {
+		return err
+	}
+	_, err = blobstore.Init(path, blobstore.InitOptions{
+		Codec: *codec,
+		Index: *index,
+		Shard: layout,
+	})
+	if err != nil {
+		return err
+	}
+	return output(map[string]interface{}{
+		"root":    path,
+		"version": blobstore.FormatVersion,
+	}, func() {
+		fmt.Printf("Initialized store in %s\n", path)
+	})
+}
+
+// }}}
+
+// migrate {{{
+
+func cmdMigrate(ctx context.Context, store *blobstore.Store, args []string) error {
+	if err := blobstore.Migrate(*root); err != nil {
+		return err
+	}
+	return output(map[string]int{"version": blobstore.FormatVersion}, func() {
+		fmt.Printf("Store is at format version %d\n", blobstore.FormatVersion)
+	})
+}
+
+// }}}
+
+// reshard {{{
+
+func cmdReshard(ctx context.Context, store *blobstore.Store, args []string) error {
+	if err := needArgs(args, 1, "<layout>"); err != nil {
+		return err
+	}
+	layout, err := blobstore.ParseShardLayout(args[0])
+	if err != nil {
+		return err
+	}
+	if err := store.Reshard(ctx, layout); err != nil {
+		return err
+	}
+	shard := blobstore.FormatShardLayout(store.ShardLayout())
+	return output(map[string]string{"shard": shard}, func() {
+		fmt.Printf("Store is sharded %s\n", shard)
+	})
+}
+
+// }}}
+
+// put {{{
+
+func cmdPut(ctx context.Context, store *blobstore.Store, args []string) error {
+	if err := needArgs(args, 1, "<file|->"); err != nil {
+		return err
+	}
+	var r io.Reader = os.Stdin
+	if args[0] != "-" {
+		fd, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer fd.Close()
+		r = fd
+	}
+	obj, err := store.Put(r)
+	if err != nil {
+		return err
+	}
+	return output(map[string]string{"id": obj.Id()}, func() {
+		fmt.Println(obj.Id())
+	})
+}
+
+// }}}
+
+// ingest {{{
+
+func cmdIngest(ctx context.Context, store *blobstore.Store, args []string) error {
+	flags := flag.NewFlagSet("ingest", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only report what would be ingested")
+	workers := flags.Int("workers", 0, "files to ingest at once (default one per CPU)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := needArgs(flags.Args(), 1, "<dir>"); err != nil {
+		return err
+	}
+
+	result, err := store.IngestContext(ctx, flags.Arg(0), blobstore.IngestOptions{
+		Workers: *workers,
+		DryRun:  *dryRun,
+	})
+	if err != nil {
+		return err
+	}
+	skipped := []map[string]string{}
+	for _, skip := range result.Skipped {
+		skipped = append(skipped, map[string]string{"path": skip.Path, "error": skip.Err.Error()})
+	}
+	return output(map[string]interface{}{
+		"dry_run": *dryRun,
+		"files":   result.Files,
+		"bytes":   result.Bytes,
+		"linked":  result.Linked,
+		"objects": result.Objects,
+		"skipped": skipped,
+	}, func() {
+		fmt.Printf("%d files (%d bytes) as %d objects; %d already linked\n",
+			result.Files, result.Bytes, result.Objects, result.Linked)
+		for _, skip := range result.Skipped {
+			fmt.Printf("skipped %s: %s\n", skip.Path, skip.Err)
+		}
+	})
+}
+
+// }}}
+
+// cat {{{
+
+func cmdCat(ctx context.Context, store *blobstore.Store, args []string) error {
+	if err := needArgs(args, 1, "<id>"); err != nil {
+		return err
+	}
+	obj, err := store.Resolve(args[0])
+	if err != nil {
+		return err
+	}
+	_, err = store.CopyContext(ctx, obj, os.Stdout)
+	return err
+}
+
+// }}}
+
+// link {{{
+
+func cmdLink(ctx context.Context, store *blobstore.Store, args []string) error {
+	if err := needArgs(args, 2, "<id> <path>"); err != nil {
+		return err
+	}
+	obj, err := store.Resolve(args[0])
+	if err != nil {
+		return err
+	}
+	if err := store.Link(obj, args[1]); err != nil {
+		return err
+	}
+	return output(map[string]string{"id": obj.Id(), "path": args[1]}, func() {
+		fmt.Printf("%s -> %s\n", args[1], obj.Id())
+	})
+}
+
+// }}}
+
+// export {{{
+
+func cmdExport(ctx context.Context, store *blobstore.Store, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	tarOutput := flags.Bool("tar", false, "write a tar to stdout rather than files")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *tarOutput {
+		if err := needArgs(flags.Args(), 1, "<stage>"); err != nil {
+			return err
+		}
+		return store.ExportTarContext(ctx, flags.Arg(0), os.Stdout)
+	}
+
+	if err := needArgs(flags.Args(), 2, "<stage> <dest>"); err != nil {
+		return err
+	}
+	if err := store.ExportContext(ctx, flags.Arg(0), flags.Arg(1)); err != nil {
+		return err
+	}
+	return output(map[string]string{"stage": flags.Arg(0), "dest": flags.Arg(1)}, func() {
+		fmt.Printf("Exported %s to %s\n", flags.Arg(0), flags.Arg(1))
+	})
+}
+
+// }}}
+
+// bundle / import {{{
+
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return fmt.Sprint(*s)
+}
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+func cmdBundle(ctx context.Context, store *blobstore.Store, args []string) error {
+	flags := flag.NewFlagSet("bundle", flag.ContinueOnError)
+	stages := stringsFlag{}
+	flags.Var(&stages, "stage", "stage path to include, with its links (repeatable)")
+	car := flags.Bool("car", false, "write a CARv1 rather than a bundle")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	opts := blobstore.BundleOptions{Stages: stages}
+	for _, arg := range flags.Args() {
+		obj, err := store.Resolve(arg)
+		if err != nil {
+			return err
+		}
+		opts.Objects = append(opts.Objects, obj)
+	}
+	if *car {
+		return store.ExportCARContext(ctx, os.Stdout, opts)
+	}
+	return store.ExportBundleContext(ctx, os.Stdout, opts)
+}
+
+func cmdImport(ctx context.Context, store *blobstore.Store, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	link := flags.Bool("link", false, "recreate links from the bundle's stage manifests")
+	car := flags.Bool("car", false, "read a CARv1 rather than a bundle")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := needArgs(flags.Args(), 1, "<bundle|->"); err != nil {
+		return err
+	}
+	var r io.Reader = os.Stdin
+	if flags.Arg(0) != "-" {
+		fd, err := os.Open(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer fd.Close()
+		r = fd
+	}
+	var (
+		result blobstore.ImportResult
+		err    error
+	)
+	if *car {
+		result, err = store.ImportCARContext(ctx, r)
+	} else {
+		result, err = store.ImportBundleContext(ctx, r, blobstore.ImportOptions{Link: *link})
+	}
+	if err != nil {
+		return err
+	}
+	return output(map[string]int{
+		"imported": result.Imported,
+		"skipped":  result.Skipped,
+		"linked":   result.Linked,
+	}, func() {
+		fmt.Printf("%d imported, %d already present, %d linked\n",
+			result.Imported, result.Skipped, result.Linked)
+	})
+}
+
+// }}}
+
+// ls {{{
+
+func cmdLs(ctx context.Context, store *blobstore.Store, args []string) error {
+	opts := blobstore.ListOptions{}
+	if len(args) > 0 {
+		opts.Prefix = args[0]
+	}
+	if *jsonOutput {
+		objects := []blobstore.Object{}
+		err := store.ListVisitorContext(ctx, opts, func(o blobstore.Object) error {
+			objects = append(objects, o)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return output(ids(objects), nil)
+	}
+	/* Stream these out as we go, since there may be a lot of them. */
+	return store.ListVisitorContext(ctx, opts, func(o blobstore.Object) error {
+		fmt.Println(o.Id())
+		return nil
+	})
+}
+
+// }}}
+
+// linked {{{
+
+func cmdLinked(ctx context.Context, store *blobstore.Store, args []string) error {
+	linked, err := store.LinkedContext(ctx)
+	if err != nil {
+		return err
+	}
+	ret := map[string][]string{}
+	for obj, paths := range linked {
+		sort.Strings(paths)
+		ret[obj.Id()] = paths
+	}
+	return output(ret, func() {
+		objects := []string{}
+		for id := range ret {
+			objects = append(objects, id)
+		}
+		sort.Strings(objects)
+		for _, id := range objects {
+			fmt.Println(id)
+			for _, p := range ret[id] {
+				fmt.Printf("  %s\n", p)
+			}
+		}
+	})
+}
+
+// }}}
+
+// paths {{{
+
+func cmdPaths(ctx context.Context, store *blobstore.Store, args []string) error {
+	paths, err := store.PathsContext(ctx)
+	if err != nil {
+		return err
+	}
+	ret := map[string]string{}
+	for p, obj := range paths {
+		ret[p] = obj.Id()
+	}
+	return output(ret, func() {
+		names := []string{}
+		for p := range ret {
+			names = append(names, p)
+		}
+		sort.Strings(names)
+		for _, p := range names {
+			fmt.Printf("%s %s\n", ret[p], p)
+		}
+	})
+}
+
+// }}}
+
+// check {{{
+
+func cmdCheck(ctx context.Context, store *blobstore.Store, args []string) error {
+	flags := flag.NewFlagSet("check", flag.ContinueOnError)
+	adopt := flags.Bool("adopt", false, "commit foreign files and links to other stores, and link them")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	problems := []blobstore.StageEntry{}
+	err := store.StageVisitorContext(ctx, func(entry blobstore.StageEntry) error {
+		if entry.Kind != blobstore.StageLinked {
+			problems = append(problems, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	stage, err := filepath.Abs(*root)
+	if err != nil {
+		return err
+	}
+	ret := []map[string]string{}
+	for _, entry := range problems {
+		kind := entry.Kind.String()
+		if *adopt && (entry.Kind == blobstore.StageForeign || entry.Kind == blobstore.StageOtherStore) {
+			rel, err := filepath.Rel(stage, entry.Path)
+			if err != nil {
+				return err
+			}
+			if _, err := store.AdoptContext(ctx, rel); err != nil {
+				return err
+			}
+			kind = "adopted"
+		}
+		ret = append(ret, map[string]string{"path": entry.Path, "kind": kind, "target": entry.Target})
+	}
+	return output(ret, func() {
+		for _, entry := range ret {
+			if entry["target"] != "" {
+				fmt.Printf("%s: %s -> %s\n", entry["kind"], entry["path"], entry["target"])
+			} else {
+				fmt.Printf("%s: %s\n", entry["kind"], entry["path"])
+			}
+		}
+	})
+}
+
+// }}}
+
+// gc {{{
+
+func cmdGC(ctx context.Context, store *blobstore.Store, args []string) error {
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only list what would be removed")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	gc := blobstore.DumbGarbageCollector{}
+	var (
+		garbage []blobstore.Object
+		err     error
+	)
+	if *dryRun {
+		garbage, err = gc.FindContext(ctx, *store)
+	} else {
+		garbage, err = store.CollectContext(ctx, gc)
+	}
+	if err != nil {
+		return err
+	}
+	return output(map[string]interface{}{
+		"dry_run": *dryRun,
+		"removed": ids(garbage),
+	}, func() {
+		for _, id := range ids(garbage) {
+			fmt.Println(id)
+		}
+	})
+}
+
+// }}}
+
+// rm {{{
+
+func cmdRm(ctx context.Context, store *blobstore.Store, args []string) error {
+	if err := needArgs(args, 1, "<id>..."); err != nil {
+		return err
+	}
+	removed := []blobstore.Object{}
+	for _, arg := range args {
+		obj, err := store.Resolve(arg)
+		if err != nil {
+			return err
+		}
+		if err := store.Remove(obj); err != nil {
+			return err
+		}
+		removed = append(removed, obj)
+	}
+	return output(map[string][]string{"removed": ids(removed)}, func() {
+		for _, id := range ids(removed) {
+			fmt.Println(id)
+		}
+	})
+}
+
+// }}}
+
+// fsck {{{
+
+func cmdFsck(ctx context.Context, store *blobstore.Store, args []string) error {
+	corrupt, err := store.Fsck(ctx, blobstore.WalkOptions{Sorted: true})
+	if err != nil {
+		return err
+	}
+	err = output(map[string][]string{"corrupt": ids(corrupt)}, func() {
+		for _, id := range ids(corrupt) {
+			fmt.Printf("corrupt: %s\n", id)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if len(corrupt) > 0 {
+		os.Exit(1)
+	}
+	return nil
+}
+
+// }}}
+
+// stat {{{
+
+func cmdStat(ctx context.Context, store *blobstore.Store, args []string) error {
+	if err := needArgs(args, 1, "<id>"); err != nil {
+		return err
+	}
+	obj, err := store.Resolve(args[0])
+	if err != nil {
+		return err
+	}
+	info, err := store.Stat(obj)
+	if err != nil {
+		return err
+	}
+	return output(map[string]interface{}{
+		"id":          obj.Id(),
+		"size":        info.Size,
+		"stored_size": info.StoredSize,
+		"codec":       info.Codec,
+		"key_id":      info.KeyID,
+		"packed":      info.Packed,
+		"chunks":      info.Chunks,
+	}, func() {
+		fmt.Printf("id:          %s\n", obj.Id())
+		fmt.Printf("size:        %d\n", info.Size)
+		fmt.Printf("stored size: %d\n", info.StoredSize)
+		if info.Codec != "" {
+			fmt.Printf("codec:       %s\n", info.Codec)
+		}
+		if info.KeyID != "" {
+			fmt.Printf("key:         %s\n", info.KeyID)
+		}
+		fmt.Printf("packed:      %t\n", info.Packed)
+		if info.Chunks > 0 {
+			fmt.Printf("chunks:      %d\n", info.Chunks)
+		}
+	})
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+/* The tests run the CLI by running the test binary again, which main()s
+ * instead of testing when this is set. */
+const runMainEnv = "BLOBSTORE_TEST_RUN_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runMainEnv) != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+/* Run the CLI on the store at root, and decode its JSON output into v. */
+func run(t *testing.T, root string, v interface{}, args ...string) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], append([]string{"-root", root, "-json"}, args...)...)
+	cmd.Env = append(os.Environ(), runMainEnv+"=1")
+	out, err := cmd.Output()
+	if err != nil {
+		stderr := ""
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			stderr = string(exitErr.Stderr)
+		}
+		t.Fatalf("blobstore %s: %v: %s", strings.Join(args, " "), err, stderr)
+	}
+	if err := json.Unmarshal(out, v); err != nil {
+		t.Fatalf("blobstore %s: %v: %q", strings.Join(args, " "), err, out)
+	}
+}
+
+func TestCLI(t *testing.T) {
+	root := t.TempDir()
+	run(t, root, &map[string]interface{}{}, "init")
+	if _, err := os.Stat(path.Join(root, ".blobs/index")); !os.IsNotExist(err) {
+		t.Fatalf("init made an index without --index: %v", err)
+	}
+
+	files := t.TempDir()
+	put := func(content string) string {
+		p := path.Join(files, "file")
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		out := map[string]string{}
+		run(t, root, &out, "put", p)
+		return out["id"]
+	}
+	kept := put("kept")
+	gone := put("gone")
+
+	run(t, root, &map[string]string{}, "link", kept[:12], "dir/kept")
+	data, err := ioutil.ReadFile(path.Join(root, "dir/kept"))
+	if err != nil || string(data) != "kept" {
+		t.Fatalf("link reads as %q, %v", data, err)
+	}
+
+	out := struct {
+		DryRun  bool     `json:"dry_run"`
+		Removed []string `json:"removed"`
+	}{}
+	run(t, root, &out, "gc", "--dry-run")
+	if !out.DryRun || !reflect.DeepEqual(out.Removed, []string{gone}) {
+		t.Fatalf("gc --dry-run: %+v", out)
+	}
+	run(t, root, &out, "gc")
+	if out.DryRun || !reflect.DeepEqual(out.Removed, []string{gone}) {
+		t.Fatalf("gc: %+v", out)
+	}
+
+	listed := []string{}
+	run(t, root, &listed, "ls")
+	if !reflect.DeepEqual(listed, []string{kept}) {
+		t.Fatalf("ls after gc: %v", listed)
+	}
+
+	indexed := t.TempDir()
+	run(t, indexed, &map[string]interface{}{}, "init", "--index")
+	if _, err := os.Stat(path.Join(indexed, ".blobs/index")); err != nil {
+		t.Fatalf("init --index made no index: %v", err)
+	}
+}
+
+// vim: foldmethod=marker
@@ -0,0 +1,426 @@
+package blobstore
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/* Blobs may be stored encoded by a Codec (compression, mostly). An encoded
+ * blob starts with codecMagic, followed by the codec name and a newline,
+ * and then the encoded bytes. A blob without that header is stored as-is,
+ * so encoded and raw blobs can live side by side in the same pool.
+ *
+ * On the off chance that raw content happens to start with codecMagic, it
+ * is committed behind an "identity" header so it can't be misread.
+ *
+ * From format version 3, the header a blob starts with also records the
+ * size of its content, as codecSizeWidth hex digits after the name and a
+ * space, so it can be found without decoding the whole thing. Headers
+ * nested inside of another (under encryption, say) don't. The size is
+ * filled in once all the content has been written. */
+var codecMagic = []byte("\x00blobstore-codec\x00")
+
+const codecSizeWidth = 16
+
+type Codec interface {
+	Name() string
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+var (
+	codecsLock = sync.RWMutex{}
+	codecs     = map[string]Codec{}
+)
+
+func init() {
+	RegisterCodec(IdentityCodec{})
+	RegisterCodec(GzipCodec{Level: gzip.DefaultCompression})
+}
+
+// RegisterCodec {{{
+
+func RegisterCodec(c Codec) {
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+	codecs[c.Name()] = c
+}
+
+func LookupCodec(name string) (Codec, error) {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+	c, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown codec: '%s'", name)
+	}
+	return c, nil
+}
+
+// }}}
+
+// SetCodec {{{
+
+func (s *Store) SetCodec(c Codec) {
+	if c != nil && c.Name() == (IdentityCodec{}).Name() {
+		c = nil
+	}
+	s.codec = c
+}
+
+// }}}
+
+// SetLinkCopies {{{
+
+/* Allow Link (and Ingest) to write a decoded copy of encrypted or chunked
+ * Objects under rawRoot for links to point at, since a link can only show
+ * the bytes of the file it points to. Those copies are plaintext, whatever
+ * the store's keys, and stay that way until the Object is removed; Rekey
+ * doesn't touch them. A chunked Object's copy costs its full size again,
+ * shared with nothing. Without this, linking either fails with
+ * ErrNeedsCopy. */
+func (s *Store) SetLinkCopies(allow bool) {
+	s.linkCopies = allow
+}
+
+// }}}
+
+// IdentityCodec {{{
+
+type IdentityCodec struct{}
+
+func (IdentityCodec) Name() string {
+	return "identity"
+}
+
+func (IdentityCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+func (IdentityCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(r), nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// }}}
+
+// GzipCodec {{{
+
+type GzipCodec struct {
+	Level int
+}
+
+func (GzipCodec) Name() string {
+	return "gzip"
+}
+
+func (g GzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, g.Level)
+}
+
+func (GzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// }}}
+
+// codec helpers {{{
+
+func writeCodecHeader(w io.Writer, c Codec) error {
+	_, err := fmt.Fprintf(w, "%s%s\n", codecMagic, c.Name())
+	return err
+}
+
+/* Write the header for c that a new blob starts with, recording size if
+ * the store's format has room for it. If it does, the offset of the size
+ * is returned, so it can be filled in by patchCodecSize when it isn't
+ * known up front. */
+func (s Store) writeOuterCodecHeader(w io.Writer, c Codec, size int64) (int64, error) {
+	if !s.sizedHeaders {
+		return 0, writeCodecHeader(w, c)
+	}
+	if _, err := fmt.Fprintf(w, "%s%s %0*x\n", codecMagic, c.Name(), codecSizeWidth, size); err != nil {
+		return 0, err
+	}
+	return int64(len(codecMagic) + len(c.Name()) + 1), nil
+}
+
+func patchCodecSize(p string, at, size int64) error {
+	fd, err := os.OpenFile(p, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(io.NewOffsetWriter(fd, at), "%0*x", codecSizeWidth, size); err != nil {
+		fd.Close()
+		return err
+	}
+	return fd.Close()
+}
+
+/* Read the codec header (if any) off of r, returning the name of the codec
+ * the rest of the stream is encoded with ("" if it's raw), and a reader
+ * positioned at the start of the encoded bytes. */
+func readCodecHeader(r io.Reader) (string, *bufio.Reader, error) {
+	name, _, br, err := readSizedCodecHeader(r)
+	return name, br, err
+}
+
+/* As readCodecHeader, also returning the size of the content, or -1 if
+ * the header doesn't say. */
+func readSizedCodecHeader(r io.Reader) (string, int64, *bufio.Reader, error) {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(len(codecMagic))
+	if err != nil && err != io.EOF {
+		return "", -1, nil, err
+	}
+	if !bytes.Equal(head, codecMagic) {
+		return "", -1, br, nil
+	}
+	if _, err := br.Discard(len(codecMagic)); err != nil {
+		return "", -1, nil, err
+	}
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return "", -1, nil, err
+	}
+	name, size, sized := strings.Cut(strings.TrimSuffix(line, "\n"), " ")
+	if !sized {
+		return name, -1, br, nil
+	}
+	n, err := strconv.ParseInt(size, 16, 64)
+	if err != nil || len(size) != codecSizeWidth || n < 0 {
+		return "", -1, nil, ErrCorrupt
+	}
+	return name, n, br, nil
+}
+
+type codecWriteCloser struct {
+	io.Writer
+	closers []io.Closer
+}
+
+func (c codecWriteCloser) Close() error {
+	for _, closer := range c.closers {
+		if err := closer.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type codecReadCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (c codecReadCloser) Close() error {
+	var ret error
+	for _, closer := range c.closers {
+		if err := closer.Close(); err != nil && ret == nil {
+			ret = err
+		}
+	}
+	return ret
+}
+
+/* Read the codec header off of the on-disk bytes of o in fd, looking
+ * through encryption (if any) to the header of the blob inside it. */
+func (s Store) innerCodecHeader(o Object, fd io.Reader) (string, *bufio.Reader, error) {
+	name, r, err := readCodecHeader(fd)
+	if err != nil || !isEncryptionCodec(name) {
+		return name, r, err
+	}
+
+	/* Encryption wraps a whole blob, which in turn always carries its own
+	 * codec header. */
+	dr, err := s.newDecrypter(name, r)
+	if err != nil {
+		return "", nil, err
+	}
+	if name, r, err = readCodecHeader(dr); err != nil {
+		return "", nil, err
+	}
+	if name == "" || isEncryptionCodec(name) {
+		return "", nil, ObjectError{ID: o.Id(), Err: ErrCorrupt}
+	}
+	return name, r, nil
+}
+
+/* Decode the on-disk bytes of o from fd, taking ownership of fd. */
+func (s Store) decode(o Object, fd io.ReadCloser) (io.ReadCloser, error) {
+	name, r, err := s.innerCodecHeader(o, fd)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+
+	if name == recipeCodecName {
+		chunks, err := s.readRecipe(r)
+		fd.Close()
+		if err != nil {
+			return nil, err
+		}
+		return &recipeReader{store: s, chunks: chunks}, nil
+	}
+
+	if name == "" {
+		return codecReadCloser{Reader: r, closers: []io.Closer{fd}}, nil
+	}
+	c, err := LookupCodec(name)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	dec, err := c.NewReader(r)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return codecReadCloser{Reader: dec, closers: []io.Closer{dec, fd}}, nil
+}
+
+func (s Store) blobCodecName(o Object) (string, error) {
+	fd, err := s.openRaw(o)
+	if err != nil {
+		return "", s.objectError(o, err)
+	}
+	defer fd.Close()
+	name, _, err := readCodecHeader(fd)
+	return name, err
+}
+
+/* Layer up the encoders for a new blob: encryption on the outside (if
+ * there are keys), then the codec (if any) inside of that. Also returns
+ * where the size goes, as writeOuterCodecHeader does. */
+func (s Store) newEncoder(w io.Writer) (io.WriteCloser, int64, error) {
+	closers := []io.Closer{}
+	codec := s.codec
+	if codec == nil {
+		codec = IdentityCodec{}
+	}
+
+	var (
+		sizeAt int64
+		err    error
+	)
+	if s.keys != nil {
+		var ew *encrypter
+		if ew, sizeAt, err = s.newEncrypter(w); err != nil {
+			return nil, 0, err
+		}
+		w = ew
+		closers = append(closers, ew)
+		err = writeCodecHeader(w, codec)
+	} else {
+		sizeAt, err = s.writeOuterCodecHeader(w, codec, 0)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	cw, err := codec.NewWriter(w)
+	if err != nil {
+		return nil, 0, err
+	}
+	closers = append([]io.Closer{cw}, closers...)
+	return codecWriteCloser{Writer: cw, closers: closers}, sizeAt, nil
+}
+
+/* Guard against raw content that looks like it has a codec header by
+ * rewriting it behind an explicit identity header. */
+func (s Store) escapeRawBlob(p string) error {
+	fd, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	head := make([]byte, len(codecMagic))
+	n, err := io.ReadFull(fd, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		fd.Close()
+		return err
+	}
+	if !bytes.Equal(head[:n], codecMagic) {
+		return fd.Close()
+	}
+	if _, err := fd.Seek(0, io.SeekStart); err != nil {
+		fd.Close()
+		return err
+	}
+	defer fd.Close()
+	fi, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := ioutil.TempFile(path.Dir(p), "blob")
+	if err != nil {
+		return err
+	}
+	if _, err := s.writeOuterCodecHeader(out, IdentityCodec{}, fi.Size()); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return err
+	}
+	if _, err := io.Copy(out, fd); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+	return os.Rename(out.Name(), p)
+}
+
+/* Linked stage paths have to see the raw bytes, so a blob stored with a
+ * codec is decoded into rawRoot once, and links point there instead. For
+ * encrypted and chunked blobs, that's only done if SetLinkCopies allows
+ * it. */
+func (s Store) materialize(o Object) (string, error) {
+	rawPath := path.Join(s.root, s.rawRoot, s.objShardPath(o))
+	if _, err := os.Stat(rawPath); err == nil {
+		return rawPath, nil
+	}
+	if err := os.MkdirAll(path.Dir(rawPath), 0755); err != nil {
+		return "", err
+	}
+
+	out, err := ioutil.TempFile(path.Dir(rawPath), "raw")
+	if err != nil {
+		return "", err
+	}
+	if _, err := s.Copy(o, out); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(out.Name())
+		return "", err
+	}
+	if err := os.Chmod(out.Name(), blobMode); err != nil {
+		os.Remove(out.Name())
+		return "", err
+	}
+	return rawPath, os.Rename(out.Name(), rawPath)
+}
+
+// }}}
+
+// vim: foldmethod=marker
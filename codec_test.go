@@ -0,0 +1,92 @@
+package blobstore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path"
+	"testing"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	contents := map[string][]byte{
+		"empty":      {},
+		"short":      []byte("short"),
+		"long":       bytes.Repeat([]byte("0123456789"), 100000),
+		"codec-like": append([]byte(codecMagic), []byte("gzip\nnot really gzip")...),
+	}
+	for _, codec := range []Codec{nil, IdentityCodec{}, GzipCodec{}} {
+		store := newTestStore(t)
+		if codec != nil {
+			store.SetCodec(codec)
+		}
+		for name, content := range contents {
+			o, err := store.Put(bytes.NewReader(content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := readString(t, store, *o); got != string(content) {
+				t.Fatalf("%v, %s: didn't round trip", codec, name)
+			}
+			info, err := store.Stat(*o)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size != int64(len(content)) {
+				t.Fatalf("%v, %s: size %d, wanted %d", codec, name, info.Size, len(content))
+			}
+			if len(content) < 10 {
+				continue
+			}
+			rc, err := store.OpenRange(*o, 3, 5)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, content[3:8]) {
+				t.Fatalf("%v, %s: range read %q", codec, name, got)
+			}
+		}
+	}
+}
+
+/* Blobs written with one codec are still read once the store has moved on
+ * to another. */
+func TestCodecChange(t *testing.T) {
+	store := newTestStore(t)
+	store.SetCodec(GzipCodec{})
+	o := putString(t, store, "written gzipped")
+	store.SetCodec(IdentityCodec{})
+	if got := readString(t, store, o); got != "written gzipped" {
+		t.Fatalf("read back %q", got)
+	}
+}
+
+/* Committing content the store already has keeps the blob that's there,
+ * whatever codec it was written with; links may point right at it. */
+func TestCommitKeepsExisting(t *testing.T) {
+	store := newTestStore(t)
+	o := putString(t, store, "linked raw")
+	if err := store.Link(o, "linked"); err != nil {
+		t.Fatal(err)
+	}
+	store.SetCodec(GzipCodec{})
+	if again := putString(t, store, "linked raw"); again != o {
+		t.Fatalf("committed as %s, not %s", again.Id(), o.Id())
+	}
+	data, err := ioutil.ReadFile(path.Join(store.root, "linked"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "linked raw" {
+		t.Fatalf("link reads %q", data)
+	}
+	if got := readString(t, store, o); got != "linked raw" {
+		t.Fatalf("read back %q", got)
+	}
+}
+
+// vim: foldmethod=marker
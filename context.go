@@ -0,0 +1,24 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+)
+
+// contextReader {{{
+
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c contextReader) Read(b []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(b)
+}
+
+// }}}
+
+// vim: foldmethod=marker
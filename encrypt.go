@@ -0,0 +1,419 @@
+package blobstore
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"strings"
+)
+
+/* Encrypted blobs are stored behind an encryptionCodecName codec header,
+ * followed by the id of the key used (and a newline), a 32 byte random
+ * salt, and then a sequence of AES-256-GCM sealed chunks. Each blob is
+ * sealed with its own key, derived from the store's key and the salt with
+ * HKDF-SHA256, so nonces only have to be unique within the one blob; they
+ * are a four byte chunk counter, zero padded. Each chunk is a one byte flag
+ * (1 on the final chunk), a four byte big endian length, and the sealed
+ * bytes. The flag is authenticated, so chunks can't be reordered, dropped
+ * or the stream truncated without it being noticed.
+ *
+ * Blobs from before per-blob keys are legacyEncryptionCodecName, sealed
+ * with the store's key directly under an 8 byte random nonce prefix in
+ * place of the salt. They're still read, and Rekey rewrites them.
+ *
+ * The plaintext is a complete blob with its own codec header, so
+ * compression happens before encryption.
+ *
+ * Chunked blobs have their recipe encrypted too, as well as each chunk.
+ *
+ * Linking an encrypted blob into the stage would mean a plaintext copy of
+ * it on disk, so that's refused unless SetLinkCopies says otherwise. */
+const (
+	encryptionCodecName       = "aes256-gcm-hkdf"
+	legacyEncryptionCodecName = "aes256-gcm"
+	encryptionChunkSize       = 64 * 1024
+	encryptionSaltSize        = 32
+	encryptionNonceSize       = 8
+)
+
+type KeyProvider interface {
+	// The id and bytes of the key new blobs should be encrypted with.
+	CurrentKey() (string, []byte, error)
+
+	// The bytes of the key with the given id, for reading existing blobs.
+	Key(id string) ([]byte, error)
+}
+
+// StaticKeys {{{
+
+type StaticKeys struct {
+	Current string
+	Keys    map[string][]byte
+}
+
+func (k StaticKeys) CurrentKey() (string, []byte, error) {
+	key, err := k.Key(k.Current)
+	return k.Current, key, err
+}
+
+func (k StaticKeys) Key(id string) ([]byte, error) {
+	key, ok := k.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("Unknown key: '%s'", id)
+	}
+	return key, nil
+}
+
+// }}}
+
+// SetKeyProvider {{{
+
+func (s *Store) SetKeyProvider(k KeyProvider) {
+	s.keys = k
+}
+
+// }}}
+
+// SetObjectIDKey {{{
+
+/* Use an HMAC-SHA256 keyed with key for object ids, rather than plain
+ * SHA256, so that someone without the key can't confirm a store holds a
+ * particular file. This changes every object id, so it has to be set
+ * before anything is committed; InitOptions.ObjectIDKey does that, and
+ * records it in the store's config, so it can't be forgotten later. */
+func (s *Store) SetObjectIDKey(key []byte) {
+	s.objectIDHasher = func() hash.Hash {
+		return hmac.New(sha256.New, key)
+	}
+}
+
+/* Set the object id key the store's config calls for, which has to be
+ * key, or none at all. */
+func (s *Store) applyObjectIDKey(config Config, key []byte) error {
+	switch {
+	case config.Hash != "hmac-sha256" && key == nil:
+		return nil
+	case config.Hash == "hmac-sha256" && key != nil:
+		if hmac.Equal([]byte(objectIDKeyCheck(key)), []byte(config.IDKeyCheck)) {
+			s.SetObjectIDKey(key)
+			return nil
+		}
+	}
+	return StageError{Path: s.root, Err: ErrObjectIDKey}
+}
+
+/* A value to tell the right object id key by, without giving it away. */
+func objectIDKeyCheck(key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("blobstore object id key"))
+	return fmt.Sprintf("%x", mac.Sum(nil))
+}
+
+// }}}
+
+// Rekey {{{
+
+/* Re-encrypt every encrypted blob that isn't under the current key, or is
+ * still legacyEncryptionCodecName. Blobs stored in the clear are left as
+ * they are; they may be hard linked into the stage, and rewriting them in
+ * place would put ciphertext there. */
+func (s Store) Rekey(ctx context.Context) error {
+	if s.keys == nil {
+		return fmt.Errorf("Store has no key provider")
+	}
+	current, _, err := s.keys.CurrentKey()
+	if err != nil {
+		return err
+	}
+
+	return s.ListVisitorContext(ctx, ListOptions{}, func(o Object) error {
+		codec, keyID, err := s.blobEncryption(o)
+		if err != nil {
+			return err
+		}
+		if keyID == "" || (keyID == current && codec == encryptionCodecName) {
+			return nil
+		}
+		chunks, err := s.Recipe(o)
+		if err != nil {
+			return err
+		}
+		if chunks != nil {
+			/* Recommitting a recipe would write it back as one big
+			 * blob; its chunks are blobs (and get rekeyed) in their own
+			 * right, so only the recipe itself needs writing again. */
+			return s.rewriteRecipe(o, chunks)
+		}
+		return s.recommit(ctx, o)
+	})
+}
+
+/* Write o back through Create and Commit, which re-encodes it with the
+ * store's current codec and key, and atomically replaces the old blob. */
+func (s Store) recommit(ctx context.Context, o Object) error {
+	w, err := s.Create()
+	if err != nil {
+		return err
+	}
+	if _, err := s.CopyContext(ctx, o, w); err != nil {
+		w.Abort()
+		return err
+	}
+	newObj, err := s.commit(*w, true)
+	if err != nil {
+		return err
+	}
+	if *newObj != o {
+		return ObjectError{ID: o.Id(), Err: ErrCorrupt}
+	}
+	return nil
+}
+
+// }}}
+
+// encryption helpers {{{
+
+func (s Store) blobKeyID(o Object) (string, error) {
+	_, keyID, err := s.blobEncryption(o)
+	return keyID, err
+}
+
+/* The encryption codec o was stored with, and the id of its key; both are
+ * "" if o isn't encrypted. */
+func (s Store) blobEncryption(o Object) (string, string, error) {
+	fd, err := s.openRaw(o)
+	if err != nil {
+		return "", "", s.objectError(o, err)
+	}
+	defer fd.Close()
+	name, r, err := readCodecHeader(fd)
+	if err != nil || !isEncryptionCodec(name) {
+		return "", "", err
+	}
+	keyID, err := r.ReadString('\n')
+	if err != nil {
+		return "", "", err
+	}
+	return name, strings.TrimSuffix(keyID, "\n"), nil
+}
+
+func isEncryptionCodec(name string) bool {
+	return name == encryptionCodecName || name == legacyEncryptionCodecName
+}
+
+/* The key to seal one blob with: HKDF-SHA256 (RFC 5869) of key, with the
+ * blob's salt. One block of output is all AES-256 needs. */
+func blobKey(key, salt []byte) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(key)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte(encryptionCodecName))
+	expand.Write([]byte{1})
+	return expand.Sum(nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(prefix []byte, counter uint32) []byte {
+	nonce := make([]byte, encryptionNonceSize+4)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encryptionNonceSize:], counter)
+	return nonce
+}
+
+// }}}
+
+// encrypter {{{
+
+type encrypter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+}
+
+/* Start an encrypted blob on w, returning the encrypter, and where in w
+ * the size of the plaintext goes, as writeOuterCodecHeader does. */
+func (s Store) newEncrypter(w io.Writer) (*encrypter, int64, error) {
+	keyID, key, err := s.keys.CurrentKey()
+	if err != nil {
+		return nil, 0, err
+	}
+	if strings.Contains(keyID, "\n") {
+		return nil, 0, fmt.Errorf("Invalid key id: '%s'", keyID)
+	}
+	salt := make([]byte, encryptionSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, 0, err
+	}
+	aead, err := newGCM(blobKey(key, salt))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	sizeAt, err := s.writeOuterCodecHeader(w, encryptionCodec{}, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, err := fmt.Fprintf(w, "%s\n", keyID); err != nil {
+		return nil, 0, err
+	}
+	if _, err := w.Write(salt); err != nil {
+		return nil, 0, err
+	}
+	return &encrypter{w: w, aead: aead, prefix: make([]byte, encryptionNonceSize)}, sizeAt, nil
+}
+
+func (e *encrypter) Write(b []byte) (int, error) {
+	e.buf = append(e.buf, b...)
+	/* Hang on to a full chunk until we know there's more after it, since
+	 * the last chunk has to be flagged as such. */
+	for len(e.buf) > encryptionChunkSize {
+		if err := e.seal(e.buf[:encryptionChunkSize], false); err != nil {
+			return 0, err
+		}
+		e.buf = e.buf[encryptionChunkSize:]
+	}
+	return len(b), nil
+}
+
+func (e *encrypter) Close() error {
+	return e.seal(e.buf, true)
+}
+
+func (e *encrypter) seal(chunk []byte, final bool) error {
+	flag := []byte{0}
+	if final {
+		flag[0] = 1
+	}
+	if e.counter == math.MaxUint32 {
+		/* The next nonce would be a repeat. */
+		return fmt.Errorf("Blob is too large to encrypt")
+	}
+	sealed := e.aead.Seal(nil, chunkNonce(e.prefix, e.counter), chunk, flag)
+	e.counter++
+
+	header := make([]byte, 5)
+	header[0] = flag[0]
+	binary.BigEndian.PutUint32(header[1:], uint32(len(sealed)))
+	if _, err := e.w.Write(header); err != nil {
+		return err
+	}
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+/* encryptionCodec only exists to give writeCodecHeader a name; the real
+ * work needs the Store's keys, so it's never registered. */
+type encryptionCodec struct{ IdentityCodec }
+
+func (encryptionCodec) Name() string {
+	return encryptionCodecName
+}
+
+// }}}
+
+// decrypter {{{
+
+type decrypter struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+	done    bool
+}
+
+/* Start reading the encrypted blob on r, whose codec header (name) has
+ * already been read. */
+func (s Store) newDecrypter(name string, r *bufio.Reader) (*decrypter, error) {
+	if s.keys == nil {
+		return nil, fmt.Errorf("Blob is encrypted, but the store has no key provider")
+	}
+	keyID, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	key, err := s.keys.Key(strings.TrimSuffix(keyID, "\n"))
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, encryptionNonceSize)
+	if name == legacyEncryptionCodecName {
+		if _, err := io.ReadFull(r, prefix); err != nil {
+			return nil, err
+		}
+	} else {
+		salt := make([]byte, encryptionSaltSize)
+		if _, err := io.ReadFull(r, salt); err != nil {
+			return nil, err
+		}
+		key = blobKey(key, salt)
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &decrypter{r: r, aead: aead, prefix: prefix}, nil
+}
+
+func (d *decrypter) Read(b []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+func (d *decrypter) open() error {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(d.r, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrCorrupt
+		}
+		return err
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > encryptionChunkSize+uint32(d.aead.Overhead()) {
+		return ErrCorrupt
+	}
+	sealed := make([]byte, length)
+	if _, err := io.ReadFull(d.r, sealed); err != nil {
+		return ErrCorrupt
+	}
+
+	chunk, err := d.aead.Open(nil, chunkNonce(d.prefix, d.counter), sealed, header[:1])
+	if err != nil {
+		return ErrCorrupt
+	}
+	d.counter++
+	d.buf = chunk
+	d.done = header[0] == 1
+	return nil
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,263 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newEncryptedStore(t *testing.T) (*Store, StaticKeys) {
+	t.Helper()
+	store := newTestStore(t)
+	keys := StaticKeys{Current: "one", Keys: map[string][]byte{
+		"one": bytes.Repeat([]byte{1}, 32),
+		"two": bytes.Repeat([]byte{2}, 32),
+	}}
+	store.SetKeyProvider(keys)
+	return store, keys
+}
+
+/* Whether needle turns up in any file under the store's root. */
+func onDisk(t *testing.T, store *Store, needle []byte) bool {
+	t.Helper()
+	found := false
+	err := filepath.Walk(store.root, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		found = found || bytes.Contains(data, needle)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return found
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	store, _ := newEncryptedStore(t)
+	secret := strings.Repeat("SECRET-CUSTOMER-DATA ", 10000)
+	o := putString(t, store, secret)
+
+	if got := readString(t, store, o); got != secret {
+		t.Fatalf("read back %d bytes, wanted %d", len(got), len(secret))
+	}
+	if onDisk(t, store, []byte("SECRET-CUSTOMER-DATA")) {
+		t.Fatal("plaintext found on disk")
+	}
+	if err := store.Verify(o); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncryptTamper(t *testing.T) {
+	store, _ := newEncryptedStore(t)
+	o := putString(t, store, strings.Repeat("tamper with me ", 10000))
+
+	p := store.objToPath(o)
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)/2] ^= 0xff
+	if err := ioutil.WriteFile(p, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Verify(o); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("flipped byte: %v", err)
+	}
+
+	/* Dropping the final chunk has to be noticed too. */
+	if err := ioutil.WriteFile(p, data[:len(data)/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Verify(o); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("truncated: %v", err)
+	}
+}
+
+func TestEncryptLink(t *testing.T) {
+	store, _ := newEncryptedStore(t)
+	o := putString(t, store, "SECRET-CUSTOMER-DATA")
+
+	if err := store.Link(o, "secret"); !errors.Is(err, ErrNeedsCopy) {
+		t.Fatalf("linking an encrypted object: %v", err)
+	}
+	if onDisk(t, store, []byte("SECRET-CUSTOMER-DATA")) {
+		t.Fatal("plaintext found on disk")
+	}
+
+	store.SetLinkCopies(true)
+	if err := store.Link(o, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(store.qualifyStagePath("secret"))
+	if err != nil || string(data) != "SECRET-CUSTOMER-DATA" {
+		t.Fatalf("%q, %v", data, err)
+	}
+}
+
+func TestEncryptChunked(t *testing.T) {
+	store, _ := newEncryptedStore(t)
+	content := make([]byte, 512*1024)
+	rand.New(rand.NewSource(1)).Read(content)
+
+	w, err := store.CreateChunked(DefaultChunkOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(content)
+	o, err := store.Commit(*w)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chunks, err := store.Recipe(*o)
+	if err != nil || len(chunks) < 2 {
+		t.Fatalf("%d chunks, %v", len(chunks), err)
+	}
+	for _, chunk := range chunks {
+		if onDisk(t, store, []byte(chunk.Object.Id())) {
+			t.Fatalf("chunk id %s is on disk in the clear", chunk.Object.Id())
+		}
+	}
+	if got := readString(t, store, *o); got != string(content) {
+		t.Fatal("chunked content didn't round trip")
+	}
+}
+
+func TestRekey(t *testing.T) {
+	store, keys := newEncryptedStore(t)
+	plain := putString(t, store, strings.Repeat("rekey me ", 10000))
+
+	w, err := store.CreateChunked(ChunkOptions{Min: 1024, Avg: 4096, Max: 16384})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := make([]byte, 64*1024)
+	rand.New(rand.NewSource(2)).Read(content)
+	w.Write(content)
+	chunked, err := store.Commit(*w)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys.Current = "two"
+	store.SetKeyProvider(keys)
+	if err := store.Rekey(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	objects, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, o := range objects {
+		keyID, err := store.blobKeyID(o)
+		if err != nil || keyID != "two" {
+			t.Fatalf("%s is under key '%s' (%v)", o.Id(), keyID, err)
+		}
+	}
+	if chunks, err := store.Recipe(*chunked); err != nil || len(chunks) < 2 {
+		t.Fatalf("chunked object lost its recipe: %d chunks, %v", len(chunks), err)
+	}
+
+	/* With the old key gone, everything still reads. */
+	delete(keys.Keys, "one")
+	store.SetKeyProvider(keys)
+	if got := readString(t, store, plain); got != strings.Repeat("rekey me ", 10000) {
+		t.Fatal("plain object didn't survive Rekey")
+	}
+	if got := readString(t, store, *chunked); got != string(content) {
+		t.Fatal("chunked object didn't survive Rekey")
+	}
+}
+
+/* A blob put before encryption was turned on may be hard linked into the
+ * stage; Rekey has to leave it (and so the link) alone. */
+func TestRekeyLinkedPlaintext(t *testing.T) {
+	store := newTestStore(t)
+	o := putString(t, store, "linked in the clear")
+	if err := store.Link(o, "clear"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, keys := newEncryptedStore(t)
+	store.SetKeyProvider(keys)
+	if err := store.Rekey(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(store.qualifyStagePath("clear"))
+	if err != nil || string(data) != "linked in the clear" {
+		t.Fatalf("%q, %v", data, err)
+	}
+	if got := readString(t, store, o); got != "linked in the clear" {
+		t.Fatalf("read back %q", got)
+	}
+}
+
+/* Blobs sealed with the store's key itself, from before per-blob keys,
+ * still read, and Rekey moves them over even if the key hasn't changed. */
+func TestEncryptLegacy(t *testing.T) {
+	store, keys := newEncryptedStore(t)
+	content := "sealed the old way"
+
+	var blob bytes.Buffer
+	fmt.Fprintf(&blob, "%s%s\n%s\n", codecMagic, legacyEncryptionCodecName, keys.Current)
+	prefix := []byte("8 bytes!")
+	blob.Write(prefix)
+	aead, err := newGCM(keys.Keys[keys.Current])
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &encrypter{w: &blob, aead: aead, prefix: prefix}
+	if err := writeCodecHeader(e, IdentityCodec{}); err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(e, content)
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	o, err := store.ParseObject(fmt.Sprintf("%x", sha256.Sum256([]byte(content))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := store.loosePath(o)
+	if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(p, blob.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := readString(t, store, o); got != content {
+		t.Fatalf("read back %q", got)
+	}
+
+	if err := store.Rekey(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if codec, keyID, err := store.blobEncryption(o); err != nil || codec != encryptionCodecName || keyID != keys.Current {
+		t.Fatalf("after Rekey: %s under '%s' (%v)", codec, keyID, err)
+	}
+	if got := readString(t, store, o); got != content {
+		t.Fatalf("read back %q after Rekey", got)
+	}
+}
+
+// vim: foldmethod=marker
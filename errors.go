@@ -0,0 +1,93 @@
+package blobstore
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrNotFound  = errors.New("No such object")
+	ErrCorrupt   = errors.New("Object content does not match its id")
+	ErrInvalidID = errors.New("Invalid object id")
+	ErrLocked    = errors.New("Store is locked")
+	ErrNotALink  = errors.New("Not a link into the store")
+	ErrChanged   = errors.New("File changed while it was being read")
+	ErrNeedsCopy = errors.New("Object can only be linked through a decoded copy")
+	ErrFileMode  = errors.New("File mode differs from the mode of blobs in the store")
+
+	ErrUnsupportedVersion = errors.New("Unsupported store format version")
+	ErrAlreadyInitialized = errors.New("Store is already initialized")
+	ErrNotAStore          = errors.New("Not a store")
+	ErrObjectIDKey        = errors.New("Object id key is missing or wrong")
+)
+
+// ObjectError {{{
+
+type ObjectError struct {
+	ID  string
+	Err error
+}
+
+func (e ObjectError) Error() string {
+	return fmt.Sprintf("%s: '%s'", e.Err, e.ID)
+}
+
+func (e ObjectError) Unwrap() error {
+	return e.Err
+}
+
+// }}}
+
+// StageError {{{
+
+type StageError struct {
+	Path string
+	Err  error
+}
+
+func (e StageError) Error() string {
+	return fmt.Sprintf("%s: '%s'", e.Err, e.Path)
+}
+
+func (e StageError) Unwrap() error {
+	return e.Err
+}
+
+// }}}
+
+// InvalidIDError {{{
+
+type InvalidIDError struct {
+	ID     string
+	Reason string
+}
+
+func (e InvalidIDError) Error() string {
+	return fmt.Sprintf("%s '%s': %s", ErrInvalidID, e.ID, e.Reason)
+}
+
+func (e InvalidIDError) Unwrap() error {
+	return ErrInvalidID
+}
+
+// }}}
+
+// AmbiguousError {{{
+
+type AmbiguousError struct {
+	Prefix     string
+	Candidates []Object
+}
+
+func (e AmbiguousError) Error() string {
+	ids := []string{}
+	for _, o := range e.Candidates {
+		ids = append(ids, o.Id())
+	}
+	return fmt.Sprintf("Ambiguous object prefix '%s': %s", e.Prefix, strings.Join(ids, ", "))
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,227 @@
+package blobstore
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type exportEntry struct {
+	rel    string
+	object Object
+	info   os.FileInfo
+
+	// Path of a regular file in the stage, for one that was never linked
+	// into the store.
+	file string
+}
+
+// Export {{{
+
+func (s Store) Export(stage, dest string) error {
+	return s.ExportContext(context.Background(), stage, dest)
+}
+
+/* Write a copy of every linked path under stage (relative to the stage, like
+ * Link) to dest, as plain files with the content of their Object, so dest
+ * has no need of the store at all. Regular files in the stage that aren't
+ * links yet are copied as they are. Files that were executable stay that
+ * way. */
+func (s Store) ExportContext(ctx context.Context, stage, dest string) error {
+	entries, err := s.exportEntries(ctx, stage, true)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := s.exportFile(ctx, entry, path.Join(dest, entry.rel)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s Store) exportFile(ctx context.Context, entry exportEntry, p string) error {
+	if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+		return err
+	}
+	out, err := ioutil.TempFile(path.Dir(p), ".export")
+	if err != nil {
+		return err
+	}
+	if err := s.copyEntry(ctx, entry, out); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+	if err := os.Chmod(out.Name(), exportMode(entry.info)); err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+	return os.Rename(out.Name(), p)
+}
+
+// }}}
+
+// ExportTar {{{
+
+func (s Store) ExportTar(stage string, w io.Writer) error {
+	return s.ExportTarContext(context.Background(), stage, w)
+}
+
+/* Stream every linked path under stage to w as a tar, with paths relative
+ * to stage, and directories before anything in them. Regular files that
+ * aren't links yet go in as they are, as Export does. */
+func (s Store) ExportTarContext(ctx context.Context, stage string, w io.Writer) error {
+	entries, err := s.exportEntries(ctx, stage, true)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	dirs := map[string]bool{}
+	for _, entry := range entries {
+		if err := writeTarDirs(tw, dirs, path.Dir(entry.rel), entry.info); err != nil {
+			return err
+		}
+
+		size, err := s.entrySize(entry)
+		if err != nil {
+			return err
+		}
+		err = tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     entry.rel,
+			Size:     size,
+			Mode:     int64(exportMode(entry.info)),
+			ModTime:  entry.info.ModTime(),
+		})
+		if err != nil {
+			return err
+		}
+		if err := s.copyEntry(ctx, entry, tw); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+/* Write headers for dir and each of its parents that haven't been written
+ * yet. */
+func writeTarDirs(tw *tar.Writer, dirs map[string]bool, dir string, info os.FileInfo) error {
+	if dir == "." || dir == "/" || dirs[dir] {
+		return nil
+	}
+	if err := writeTarDirs(tw, dirs, path.Dir(dir), info); err != nil {
+		return err
+	}
+	dirs[dir] = true
+	return tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     dir + "/",
+		Mode:     0755,
+		ModTime:  info.ModTime(),
+	})
+}
+
+// }}}
+
+// export helpers {{{
+
+/* Every linked path under stage, relative to it, in sorted order; and with
+ * foreign, every regular file too. */
+func (s Store) exportEntries(ctx context.Context, stage string, foreign bool) ([]exportEntry, error) {
+	root := path.Clean(s.qualifyStagePath(stage))
+	paths, err := s.PathsContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []exportEntry{}
+	for p, obj := range paths {
+		rel, err := filepath.Rel(root, p)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			continue
+		}
+		if rel == "." {
+			/* stage is itself a link. */
+			rel = path.Base(p)
+		}
+		/* Stat follows the link, so this is the mode of whatever it
+		 * points at. */
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, StageError{Path: p, Err: err}
+		}
+		entries = append(entries, exportEntry{rel: filepath.ToSlash(rel), object: obj, info: info})
+	}
+
+	err = s.stageWalk(ctx, root, func(p string, info os.FileInfo) error {
+		if !foreign || !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			rel = path.Base(p)
+		}
+		entries = append(entries, exportEntry{rel: filepath.ToSlash(rel), info: info, file: p})
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].rel < entries[j].rel
+	})
+	return entries, nil
+}
+
+func (s Store) entrySize(entry exportEntry) (int64, error) {
+	if entry.file != "" {
+		return entry.info.Size(), nil
+	}
+	return s.objectSize(entry.object)
+}
+
+/* Copy the content of entry to w; for a plain file, exactly as much as
+ * there was when it was listed, so it matches entrySize. */
+func (s Store) copyEntry(ctx context.Context, entry exportEntry, w io.Writer) error {
+	if entry.file == "" {
+		_, err := s.CopyContext(ctx, entry.object, w)
+		return err
+	}
+	fd, err := os.Open(entry.file)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	n, err := io.CopyN(w, contextReader{ctx: ctx, r: fd}, entry.info.Size())
+	if err == io.EOF || n != entry.info.Size() {
+		return StageError{Path: entry.file, Err: ErrChanged}
+	}
+	return err
+}
+
+func exportMode(info os.FileInfo) os.FileMode {
+	if info.Mode().Perm()&0111 != 0 {
+		return 0755
+	}
+	return 0644
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,82 @@
+package blobstore
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+/* A stage with one file linked into the store, and one not yet. */
+func newExportStage(t *testing.T) *Store {
+	t.Helper()
+	store := newTestStore(t)
+	store.SetCodec(GzipCodec{})
+	o := putString(t, store, "linked content")
+	if err := store.Link(o, "stage/linked"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(path.Join(store.root, "stage/sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(store.root, "stage/sub/foreign"), []byte("foreign content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestExport(t *testing.T) {
+	store := newExportStage(t)
+	dest := t.TempDir()
+	if err := store.Export("stage", dest); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"linked":      "linked content",
+		"sub/foreign": "foreign content",
+	} {
+		got, err := ioutil.ReadFile(path.Join(dest, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Fatalf("%s: %q, wanted %q", name, got, want)
+		}
+	}
+}
+
+func TestExportTar(t *testing.T) {
+	store := newExportStage(t)
+	buf := bytes.Buffer{}
+	if err := store.ExportTar("stage", &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{}
+	tr := tar.NewReader(&buf)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[header.Name] = string(data)
+	}
+	if len(files) != 2 || files["linked"] != "linked content" || files["sub/foreign"] != "foreign content" {
+		t.Fatalf("tar held %v", files)
+	}
+}
+
+// vim: foldmethod=marker
@@ -0,0 +1,316 @@
+package blobstore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+/* Every store created by Init has a config file at configPath, recording
+ * which version of the on-disk format it's in, and the settings that have
+ * to stay the same for its whole life (or until a migration changes them).
+ *
+ * Stores from before there was a config file are format version 0. They
+ * use the same layout as version 1, so Load still takes them, but Migrate
+ * will give them a config file. */
+const (
+	FormatVersion = 3
+
+	configPath = ".blobs/config.json"
+)
+
+type Config struct {
+	Version int `json:"version"`
+
+	// Hash used for object ids: "sha256", or "hmac-sha256" for stores
+	// Init'd with an ObjectIDKey, along with a check value for the key
+	// (never the key itself), so a wrong one is refused.
+	Hash       string `json:"hash"`
+	IDKeyCheck string `json:"id_key_check,omitempty"`
+
+	// Codec new blobs are committed with, if any.
+	Codec string `json:"codec,omitempty"`
+
+	// Shard layout of blobRoot, and the layout being moved away from if a
+	// Reshard is under way. An empty layout means no sharding at all.
+	Shard         []int `json:"shard"`
+	PreviousShard []int `json:"previous_shard,omitempty"`
+}
+
+type InitOptions struct {
+	// Codec new blobs are committed with, if any.
+	Codec string
+
+	// Keep a reverse index of Object to stage paths from the start.
+	Index bool
+
+	// Shard layout of blobRoot; nil means defaultShardLayout.
+	Shard []int
+
+	// Key object ids with HMAC-SHA256 rather than plain SHA256; see
+	// SetObjectIDKey. It has to be given to LoadWithOptions from then on.
+	ObjectIDKey []byte
+}
+
+type Migration struct {
+	From, To int
+	Migrate  func(root string, config *Config) error
+}
+
+var migrations = []Migration{
+	{From: 0, To: 1, Migrate: func(root string, config *Config) error {
+		/* Nothing moves; v1 only adds the config file. */
+		config.Hash = "sha256"
+		return nil
+	}},
+	{From: 1, To: 2, Migrate: func(root string, config *Config) error {
+		/* v2 records the shard layout, which up to now was always the
+		 * default. */
+		config.Shard = defaultShardLayout
+		return nil
+	}},
+	{From: 2, To: 3, Migrate: func(root string, config *Config) error {
+		/* v3 blobs record their size in their codec header. Older ones
+		 * are still read fine without, so nothing has to be rewritten. */
+		return nil
+	}},
+}
+
+// Init {{{
+
+func Init(p string, opts InitOptions) (*Store, error) {
+	absPath, err := filepath.Abs(p)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(path.Join(absPath, configPath)); err == nil {
+		return nil, StageError{Path: absPath, Err: ErrAlreadyInitialized}
+	}
+	if opts.Codec != "" {
+		if _, err := LookupCodec(opts.Codec); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Shard == nil {
+		opts.Shard = defaultShardLayout
+	}
+	if err := validShardLayout(opts.Shard); err != nil {
+		return nil, err
+	}
+	if !sameShardLayout(opts.Shard, defaultShardLayout) {
+		/* A store from before there was a config file has its blobs in the
+		 * default layout; writing any other into a config would lose them. */
+		legacy, err := hasLooseBlobs(path.Join(absPath, ".blobs/store"))
+		if err != nil {
+			return nil, err
+		}
+		if legacy {
+			return nil, StageError{Path: absPath, Err: fmt.Errorf(
+				"%w, without a config; Migrate it, then Reshard", ErrAlreadyInitialized,
+			)}
+		}
+	}
+
+	for _, dir := range []string{".blobs/store", ".blobs/new"} {
+		if err := os.MkdirAll(path.Join(absPath, dir), 0755); err != nil {
+			return nil, err
+		}
+	}
+	config := Config{
+		Version: FormatVersion,
+		Hash:    "sha256",
+		Codec:   opts.Codec,
+		Shard:   opts.Shard,
+	}
+	if opts.ObjectIDKey != nil {
+		config.Hash = "hmac-sha256"
+		config.IDKeyCheck = objectIDKeyCheck(opts.ObjectIDKey)
+	}
+	if err := writeConfig(absPath, config); err != nil {
+		return nil, err
+	}
+
+	store, err := LoadWithOptions(absPath, LoadOptions{ObjectIDKey: opts.ObjectIDKey})
+	if err != nil {
+		return nil, err
+	}
+	if opts.Index {
+		if err := store.Reindex(); err != nil {
+			return nil, err
+		}
+	}
+	return store, nil
+}
+
+/* Whether there's any blob at all under dir. */
+func hasLooseBlobs(dir string) (bool, error) {
+	found := errors.New("found")
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			return found
+		}
+		return nil
+	})
+	switch {
+	case err == found:
+		return true, nil
+	case os.IsNotExist(err):
+		return false, nil
+	}
+	return false, err
+}
+
+// }}}
+
+// Migrate {{{
+
+/* Bring the store at p up to FormatVersion, one Migration at a time. */
+func Migrate(p string) error {
+	absPath, err := filepath.Abs(p)
+	if err != nil {
+		return err
+	}
+	/* Nothing here reads or writes objects, so it's no matter if the
+	 * store needs a key for their ids. */
+	store, _, err := load(absPath)
+	if err != nil {
+		return err
+	}
+	unlock, err := store.lock("migrate")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	/* Read it again now we hold the lock, in case someone beat us to it. */
+	config, err := readConfig(absPath)
+	if err != nil {
+		return err
+	}
+
+	for config.Version < FormatVersion {
+		var migration *Migration
+		for i := range migrations {
+			if migrations[i].From == config.Version {
+				migration = &migrations[i]
+				break
+			}
+		}
+		if migration == nil {
+			return unsupportedVersion(absPath, config.Version)
+		}
+		if err := migration.Migrate(absPath, &config); err != nil {
+			return err
+		}
+		config.Version = migration.To
+		if err := writeConfig(absPath, config); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// }}}
+
+// config helpers {{{
+
+/* Read the config of the store at root; stores without one are version 0. */
+func readConfig(root string) (Config, error) {
+	data, err := ioutil.ReadFile(path.Join(root, configPath))
+	if os.IsNotExist(err) {
+		return Config{Version: 0, Hash: "sha256"}, nil
+	}
+	if err != nil {
+		return Config{}, err
+	}
+	config := Config{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return Config{}, StageError{Path: path.Join(root, configPath), Err: ErrCorrupt}
+	}
+	return config, nil
+}
+
+func writeConfig(root string, config Config) error {
+	p := path.Join(root, configPath)
+	if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+		return err
+	}
+	return writeJSONFile(p, config)
+}
+
+/* Write v as JSON to p, by way of a temporary file, so readers never see
+ * half of it. */
+func writeJSONFile(p string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fd, err := ioutil.TempFile(path.Dir(p), "."+path.Base(p))
+	if err != nil {
+		return err
+	}
+	if _, err := fd.Write(append(data, '\n')); err != nil {
+		fd.Close()
+		os.Remove(fd.Name())
+		return err
+	}
+	if err := fd.Close(); err != nil {
+		os.Remove(fd.Name())
+		return err
+	}
+	if err := os.Chmod(fd.Name(), 0644); err != nil {
+		os.Remove(fd.Name())
+		return err
+	}
+	return os.Rename(fd.Name(), p)
+}
+
+/* Make sure config is something this version of the package can read and
+ * write, and apply its settings to s. */
+func (s *Store) applyConfig(config Config) error {
+	if config.Version < 0 || config.Version > FormatVersion {
+		return unsupportedVersion(s.root, config.Version)
+	}
+	s.sizedHeaders = config.Version >= 3
+	if config.Hash != "sha256" && config.Hash != "hmac-sha256" {
+		return fmt.Errorf("Unsupported object id hash: '%s'", config.Hash)
+	}
+	if config.Codec != "" {
+		codec, err := LookupCodec(config.Codec)
+		if err != nil {
+			return err
+		}
+		s.SetCodec(codec)
+	}
+	if config.Shard != nil {
+		if err := validShardLayout(config.Shard); err != nil {
+			return err
+		}
+		s.shard = config.Shard
+	}
+	if config.PreviousShard != nil {
+		if err := validShardLayout(config.PreviousShard); err != nil {
+			return err
+		}
+		s.oldShard = config.PreviousShard
+	}
+	return nil
+}
+
+func unsupportedVersion(root string, version int) error {
+	return StageError{
+		Path: root,
+		Err:  fmt.Errorf("%w %d (this package supports up to %d)", ErrUnsupportedVersion, version, FormatVersion),
+	}
+}
+
+// }}}
+
+// vim: foldmethod=marker
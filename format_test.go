@@ -0,0 +1,127 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"testing"
+)
+
+/* A store from before config files: blobs, but nothing saying so. */
+func newLegacyStore(t *testing.T) (string, Object) {
+	t.Helper()
+	store := newTestStore(t)
+	o := putString(t, store, "from long ago")
+	if err := os.Remove(path.Join(store.root, configPath)); err != nil {
+		t.Fatal(err)
+	}
+	return store.root, o
+}
+
+func TestInitLegacyShard(t *testing.T) {
+	root, o := newLegacyStore(t)
+
+	_, err := Init(root, InitOptions{Shard: []int{2}})
+	if !errors.Is(err, ErrAlreadyInitialized) {
+		t.Fatalf("init over legacy blobs with a new layout gave %v", err)
+	}
+
+	store, err := Init(root, InitOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readString(t, store, o); got != "from long ago" {
+		t.Fatalf("read back %q", got)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	root, o := newLegacyStore(t)
+	if err := Migrate(root); err != nil {
+		t.Fatal(err)
+	}
+	config, err := readConfig(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Version != FormatVersion || !sameShardLayout(config.Shard, defaultShardLayout) {
+		t.Fatalf("migrated to %+v", config)
+	}
+
+	store, err := Load(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readString(t, store, o); got != "from long ago" {
+		t.Fatalf("read back %q", got)
+	}
+
+	/* And once it's migrated, it can move on to another layout. */
+	if err := store.Reshard(context.Background(), []int{2}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readString(t, store, o); got != "from long ago" {
+		t.Fatalf("read back %q after reshard", got)
+	}
+}
+
+func TestLoadNewerVersion(t *testing.T) {
+	store := newTestStore(t)
+	if err := writeConfig(store.root, Config{Version: FormatVersion + 1, Hash: "sha256"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(store.root); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("loading a newer store gave %v", err)
+	}
+}
+
+func TestLoadNotAStore(t *testing.T) {
+	for _, dir := range []string{t.TempDir(), path.Join(t.TempDir(), "missing")} {
+		if _, err := Load(dir); !errors.Is(err, ErrNotAStore) {
+			t.Fatalf("loading %s gave %v", dir, err)
+		}
+	}
+	if err := Migrate(t.TempDir()); !errors.Is(err, ErrNotAStore) {
+		t.Fatalf("migrating an empty directory gave %v", err)
+	}
+}
+
+/* A store keyed for its object ids says so, and won't load without the
+ * same key, which would give every object a different id. */
+func TestObjectIDKey(t *testing.T) {
+	key := []byte("object id key")
+	store, err := Init(t.TempDir(), InitOptions{ObjectIDKey: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := putString(t, store, "keyed")
+	if o.Id() == putString(t, newTestStore(t), "keyed").Id() {
+		t.Fatal("keyed store gave the same id as an unkeyed one")
+	}
+
+	for _, wrong := range [][]byte{nil, []byte("some other key")} {
+		if _, err := LoadWithOptions(store.root, LoadOptions{ObjectIDKey: wrong}); !errors.Is(err, ErrObjectIDKey) {
+			t.Fatalf("loading with key %q gave %v", wrong, err)
+		}
+	}
+	if _, err := LoadWithOptions(newTestStore(t).root, LoadOptions{ObjectIDKey: key}); !errors.Is(err, ErrObjectIDKey) {
+		t.Fatalf("loading an unkeyed store with a key gave %v", err)
+	}
+
+	reloaded, err := LoadWithOptions(store.root, LoadOptions{ObjectIDKey: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readString(t, reloaded, o); got != "keyed" {
+		t.Fatalf("read back %q", got)
+	}
+	if bad, err := reloaded.Fsck(context.Background(), WalkOptions{}); err != nil || len(bad) != 0 {
+		t.Fatalf("fsck found %d bad objects, %v", len(bad), err)
+	}
+	if err := Migrate(store.root); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// vim: foldmethod=marker
@@ -0,0 +1,340 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+/* StageFS is an fs.FS over the links under a stage path, as Paths sees
+ * them, with each file reading as the content of its Object, and any
+ * regular files there as themselves. It's a snapshot of the stage as of
+ * Store.FS; links made after won't show up. */
+type StageFS struct {
+	store Store
+	files map[string]exportEntry
+	dirs  map[string][]string
+}
+
+var (
+	_ fs.StatFS    = &StageFS{}
+	_ fs.ReadDirFS = &StageFS{}
+	_ fs.StatFS    = ObjectsFS{}
+	_ fs.ReadDirFS = ObjectsFS{}
+)
+
+// StageFS {{{
+
+/* An fs.FS of everything linked under stage (relative to the stage, like
+ * Link). */
+func (s Store) FS(stage string) (*StageFS, error) {
+	return s.FSContext(context.Background(), stage)
+}
+
+func (s Store) FSContext(ctx context.Context, stage string) (*StageFS, error) {
+	entries, err := s.exportEntries(ctx, stage, true)
+	if err != nil {
+		return nil, err
+	}
+	sfs := &StageFS{
+		store: s,
+		files: map[string]exportEntry{},
+		dirs:  map[string][]string{".": {}},
+	}
+	for _, entry := range entries {
+		sfs.files[entry.rel] = entry
+		for child := entry.rel; child != "."; child = path.Dir(child) {
+			dir := path.Dir(child)
+			_, known := sfs.dirs[dir]
+			sfs.dirs[dir] = append(sfs.dirs[dir], path.Base(child))
+			if known {
+				break
+			}
+		}
+	}
+	for _, children := range sfs.dirs {
+		sort.Strings(children)
+	}
+	return sfs, nil
+}
+
+func (sfs *StageFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if entry, ok := sfs.files[name]; ok {
+		var (
+			reader io.ReadCloser
+			err    error
+		)
+		if entry.file != "" {
+			reader, err = os.Open(entry.file)
+		} else {
+			reader, err = sfs.store.OpenReader(entry.object)
+		}
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		return &objectFile{reader: reader, info: sfs.fileInfo(name, entry)}, nil
+	}
+	if _, ok := sfs.dirs[name]; ok {
+		return &dirFile{info: dirInfo(name), list: func() ([]fs.DirEntry, error) {
+			return sfs.ReadDir(name)
+		}}, nil
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+func (sfs *StageFS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	if entry, ok := sfs.files[name]; ok {
+		return sfs.fileInfo(name, entry), nil
+	}
+	if _, ok := sfs.dirs[name]; ok {
+		return dirInfo(name), nil
+	}
+	return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
+
+func (sfs *StageFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	children, ok := sfs.dirs[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	ret := []fs.DirEntry{}
+	for _, child := range children {
+		info, err := sfs.Stat(path.Join(name, child))
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, fs.FileInfoToDirEntry(info))
+	}
+	return ret, nil
+}
+
+func (sfs *StageFS) fileInfo(name string, entry exportEntry) fs.FileInfo {
+	return objectInfo{
+		name:    path.Base(name),
+		mode:    exportMode(entry.info),
+		modTime: entry.info.ModTime(),
+		size: func() int64 {
+			size, err := sfs.store.entrySize(entry)
+			if err != nil {
+				return 0
+			}
+			return size
+		},
+	}
+}
+
+// }}}
+
+// ObjectsFS {{{
+
+/* ObjectsFS is an fs.FS with every Object in Pool as a file in its root,
+ * named by id. Pool can be a Store, or anything else that is one, such as
+ * a remote one over HTTP; for a Store, files are seekable. */
+type ObjectsFS struct {
+	Pool Pool
+}
+
+/* Pools that can hand out seekable readers, and sizes, as a Store can. */
+type readerPool interface {
+	OpenReader(o Object) (*ObjectReader, error)
+}
+
+type statPool interface {
+	Stat(o Object) (ObjectInfo, error)
+}
+
+func (ofs ObjectsFS) Open(name string) (fs.File, error) {
+	if name == "." {
+		return &dirFile{info: dirInfo("."), list: func() ([]fs.DirEntry, error) {
+			return ofs.ReadDir(".")
+		}}, nil
+	}
+	o, err := ofs.object("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	if rp, ok := ofs.Pool.(readerPool); ok {
+		reader, err := rp.OpenReader(o)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		return &objectFile{reader: reader, info: objectInfo{name: name, mode: 0444, size: func() int64 {
+			size, _ := reader.Size()
+			return size
+		}}}, nil
+	}
+	rc, err := ofs.Pool.Open(o)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &objectFile{reader: rc, info: objectInfo{name: name, mode: 0444, size: func() int64 {
+		return 0
+	}}}, nil
+}
+
+func (ofs ObjectsFS) Stat(name string) (fs.FileInfo, error) {
+	if name == "." {
+		return dirInfo("."), nil
+	}
+	o, err := ofs.object("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	if !ofs.Pool.Exists(o) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return ofs.objectInfo(o), nil
+}
+
+/* Info for o, sized lazily, through Stat where Pool has it. */
+func (ofs ObjectsFS) objectInfo(o Object) objectInfo {
+	return objectInfo{name: o.Id(), mode: 0444, size: func() int64 {
+		if st, ok := ofs.Pool.(statPool); ok {
+			if info, err := st.Stat(o); err == nil {
+				return info.Size
+			}
+		}
+		return 0
+	}}
+}
+
+func (ofs ObjectsFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if name != "." {
+		if _, err := ofs.object("readdir", name); err != nil {
+			return nil, err
+		}
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("Not a directory")}
+	}
+	/* Everything listed exists, as far as anyone can tell; there's no
+	 * need to ask again for each one. */
+	ret := []fs.DirEntry{}
+	err := ofs.Pool.ListVisitor(ListOptions{}, func(o Object) error {
+		ret = append(ret, fs.FileInfoToDirEntry(ofs.objectInfo(o)))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name() < ret[j].Name() })
+	return ret, nil
+}
+
+func (ofs ObjectsFS) object(op, name string) (Object, error) {
+	if !fs.ValidPath(name) {
+		return Object{}, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	o, err := ParseObject(name)
+	if err != nil {
+		return Object{}, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return o, nil
+}
+
+// }}}
+
+// files {{{
+
+type objectFile struct {
+	reader io.ReadCloser
+	info   fs.FileInfo
+}
+
+func (f *objectFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *objectFile) Read(b []byte) (int, error) { return f.reader.Read(b) }
+func (f *objectFile) Close() error               { return f.reader.Close() }
+
+func (f *objectFile) Seek(offset int64, whence int) (int64, error) {
+	if seeker, ok := f.reader.(io.Seeker); ok {
+		return seeker.Seek(offset, whence)
+	}
+	return 0, &fs.PathError{Op: "seek", Path: f.info.Name(), Err: errors.New("Not seekable")}
+}
+
+func (f *objectFile) ReadAt(b []byte, off int64) (int, error) {
+	if readerAt, ok := f.reader.(io.ReaderAt); ok {
+		return readerAt.ReadAt(b, off)
+	}
+	return 0, &fs.PathError{Op: "read", Path: f.info.Name(), Err: errors.New("Not seekable")}
+}
+
+type dirFile struct {
+	info    fs.FileInfo
+	list    func() ([]fs.DirEntry, error)
+	entries []fs.DirEntry
+	read    bool
+}
+
+func (d *dirFile) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *dirFile) Close() error               { return nil }
+
+func (d *dirFile) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.Name(), Err: errors.New("Is a directory")}
+}
+
+func (d *dirFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.read {
+		entries, err := d.list()
+		if err != nil {
+			return nil, err
+		}
+		d.entries, d.read = entries, true
+	}
+	if n <= 0 {
+		ret := d.entries
+		d.entries = nil
+		return ret, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+	ret := d.entries[:n]
+	d.entries = d.entries[n:]
+	return ret, nil
+}
+
+type objectInfo struct {
+	name    string
+	mode    fs.FileMode
+	modTime time.Time
+	size    func() int64
+	dir     bool
+}
+
+func dirInfo(name string) objectInfo {
+	return objectInfo{name: path.Base(name), mode: fs.ModeDir | 0755, dir: true}
+}
+
+func (i objectInfo) Name() string       { return i.name }
+func (i objectInfo) Mode() fs.FileMode  { return i.mode }
+func (i objectInfo) ModTime() time.Time { return i.modTime }
+func (i objectInfo) IsDir() bool        { return i.dir }
+func (i objectInfo) Sys() interface{}   { return nil }
+
+func (i objectInfo) Size() int64 {
+	if i.size == nil {
+		return 0
+	}
+	return i.size()
+}
+
+// }}}
+
+// vim: foldmethod=marker
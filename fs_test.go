@@ -0,0 +1,59 @@
+package blobstore
+
+import (
+	"io/fs"
+	"testing"
+	"testing/fstest"
+)
+
+func TestObjectsFS(t *testing.T) {
+	store := newTestStore(t)
+	store.SetCodec(GzipCodec{})
+	a := putString(t, store, "first")
+	b := putString(t, store, "second")
+	if err := fstest.TestFS(ObjectsFS{Pool: store}, a.Id(), b.Id()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+/* A Pool that counts Exists calls. */
+type existsCountingPool struct {
+	Pool
+	exists int
+}
+
+func (p *existsCountingPool) Exists(o Object) bool {
+	p.exists++
+	return p.Pool.Exists(o)
+}
+
+func TestObjectsFSReadDir(t *testing.T) {
+	store := newTestStore(t)
+	for _, content := range []string{"one", "two", "three"} {
+		putString(t, store, content)
+	}
+	pool := &existsCountingPool{Pool: store}
+	entries, err := fs.ReadDir(ObjectsFS{Pool: pool}, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("%d entries", len(entries))
+	}
+	if pool.exists != 0 {
+		t.Fatalf("ReadDir asked Exists %d times", pool.exists)
+	}
+}
+
+func TestStageFS(t *testing.T) {
+	store := newExportStage(t)
+	sfs, err := store.FS("stage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(sfs, "linked", "sub/foreign"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// vim: foldmethod=marker
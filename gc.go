@@ -1,23 +1,64 @@
 package blobstore
 
+import (
+	"context"
+	"errors"
+)
+
 type GarbageCollector interface {
 	Find(s Store) ([]Object, error)
 }
 
+/* GarbageCollectors that can be cancelled part way through their search
+ * should implement this too; Store.GCContext will prefer it over Find. */
+type ContextGarbageCollector interface {
+	GarbageCollector
+	FindContext(ctx context.Context, s Store) ([]Object, error)
+}
+
 type DumbGarbageCollector struct{}
 
 // Find {{{
 
 func (d DumbGarbageCollector) Find(s Store) ([]Object, error) {
-	linked, err := s.Linked()
+	return d.FindContext(context.Background(), s)
+}
+
+func (d DumbGarbageCollector) FindContext(ctx context.Context, s Store) ([]Object, error) {
+	linked, err := s.LinkedContext(ctx)
 	if err != nil {
 		return nil, err
 	}
-	list, err := s.List()
+	list, err := s.ListContext(ctx)
 	if err != nil {
 		return nil, err
 	}
 
+	/* Pins are as good as links. */
+	pinned, err := s.PinnedContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, obj := range pinned {
+		if _, ok := linked[obj]; !ok {
+			linked[obj] = nil
+		}
+	}
+
+	/* Chunks aren't linked into the stage, but they're live as long as a
+	 * recipe that's linked needs them. */
+	for obj := range linked {
+		chunks, err := s.Recipe(obj)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+		for _, chunk := range chunks {
+			if _, ok := linked[chunk.Object]; !ok {
+				linked[chunk.Object] = nil
+			}
+		}
+	}
+
 	ret := []Object{}
 	for _, node := range list {
 		if _, ok := linked[node]; !ok {
@@ -0,0 +1,403 @@
+package http
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"pault.ag/go/blobstore"
+)
+
+/* RemoteStore talks to a Handler, and offers the same operations as a
+ * local blobstore.Store (it's a blobstore.Pool), so callers can be pointed
+ * at either.
+ *
+ * Requests that fail with a network error or a 5xx are retried with
+ * exponential backoff. Downloads that are cut off part way through resume
+ * where they left off with a Range request, and are checked against their
+ * id once they're done. */
+type RemoteStore struct {
+	// Base URL of the Handler, such as "https://blobs.example.com".
+	URL string
+
+	Client *http.Client
+
+	// How many times to try a request before giving up, and how long to
+	// wait before the first retry; each retry after waits twice as long.
+	Attempts int
+	Backoff  time.Duration
+
+	// Don't check downloads against their id. This is needed for stores
+	// that use keyed object ids.
+	SkipVerify bool
+}
+
+var _ blobstore.Pool = &RemoteStore{}
+
+// NewRemoteStore {{{
+
+func NewRemoteStore(baseURL string) *RemoteStore {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = 100
+	transport.MaxIdleConnsPerHost = 32
+
+	return &RemoteStore{
+		URL:      strings.TrimSuffix(baseURL, "/"),
+		Client:   &http.Client{Transport: transport},
+		Attempts: 5,
+		Backoff:  100 * time.Millisecond,
+	}
+}
+
+// }}}
+
+// Exists {{{
+
+func (r *RemoteStore) Exists(o blobstore.Object) bool {
+	resp, err := r.do(func() (*http.Request, error) {
+		return http.NewRequest(http.MethodHead, r.blobURL(o), nil)
+	})
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return true
+}
+
+// }}}
+
+// Open {{{
+
+func (r *RemoteStore) Open(o blobstore.Object) (io.ReadCloser, error) {
+	return r.OpenRange(o, 0, -1)
+}
+
+/* Open length bytes of o starting at offset. A negative length reads to
+ * the end of the Object. Only whole Objects are checked against their id. */
+func (r *RemoteStore) OpenRange(o blobstore.Object, offset, length int64) (io.ReadCloser, error) {
+	d := &download{store: r, object: o, pos: offset, end: -1}
+	if length >= 0 {
+		d.end = offset + length
+	}
+	if offset == 0 && length < 0 && !r.SkipVerify {
+		d.hash = sha256.New()
+	}
+	if err := d.connect(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// }}}
+
+// Create / Commit {{{
+
+/* Writer spools an upload to a local temporary file, so it can be hashed
+ * before it's sent, and sent again if a request fails part way. */
+type Writer struct {
+	fd   *os.File
+	hash hash.Hash
+}
+
+func (w Writer) Write(b []byte) (int, error) {
+	n, err := w.fd.Write(b)
+	w.hash.Write(b[:n])
+	return n, err
+}
+
+func (w Writer) Close() error {
+	return w.fd.Close()
+}
+
+func (w Writer) Abort() error {
+	w.fd.Close()
+	return os.Remove(w.fd.Name())
+}
+
+func (r *RemoteStore) Create() (*Writer, error) {
+	fd, err := ioutil.TempFile("", "blobstore-upload")
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{fd: fd, hash: sha256.New()}, nil
+}
+
+func (r *RemoteStore) Commit(w Writer) (*blobstore.Object, error) {
+	defer w.Abort()
+
+	obj, err := blobstore.ParseObject(fmt.Sprintf("%x", w.hash.Sum(nil)))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := r.do(func() (*http.Request, error) {
+		if _, err := w.fd.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		/* Hide the *os.File, or the request will close it on us. */
+		req, err := http.NewRequest(http.MethodPut, r.blobURL(obj), ioutil.NopCloser(w.fd))
+		if err != nil {
+			return nil, err
+		}
+		fi, err := w.fd.Stat()
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = fi.Size()
+		return req, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	upload := UploadResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&upload); err != nil {
+		return nil, err
+	}
+	if upload.ID != obj.Id() {
+		return nil, blobstore.ObjectError{ID: obj.Id(), Err: blobstore.ErrCorrupt}
+	}
+	return &obj, nil
+}
+
+func (r *RemoteStore) Put(reader io.Reader) (*blobstore.Object, error) {
+	w, err := r.Create()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(w, reader); err != nil {
+		w.Abort()
+		return nil, err
+	}
+	return r.Commit(*w)
+}
+
+// }}}
+
+// List {{{
+
+func (r *RemoteStore) ListVisitor(opts blobstore.ListOptions, progn func(blobstore.Object) error) error {
+	after := opts.After
+	for {
+		query := url.Values{}
+		query.Set("prefix", opts.Prefix)
+		query.Set("after", after)
+		resp, err := r.do(func() (*http.Request, error) {
+			return http.NewRequest(http.MethodGet, r.URL+"/blobs?"+query.Encode(), nil)
+		})
+		if err != nil {
+			return err
+		}
+		page := ListResponse{}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		for _, id := range page.Objects {
+			obj, err := blobstore.ParseObject(id)
+			if err != nil {
+				return err
+			}
+			if err := progn(obj); err != nil {
+				return err
+			}
+		}
+		if page.Next == "" {
+			return nil
+		}
+		after = page.Next
+	}
+}
+
+func (r *RemoteStore) List() ([]blobstore.Object, error) {
+	ret := []blobstore.Object{}
+	err := r.ListVisitor(blobstore.ListOptions{}, func(o blobstore.Object) error {
+		ret = append(ret, o)
+		return nil
+	})
+	return ret, err
+}
+
+// }}}
+
+// Remove {{{
+
+func (r *RemoteStore) Remove(o blobstore.Object) error {
+	resp, err := r.do(func() (*http.Request, error) {
+		return http.NewRequest(http.MethodDelete, r.blobURL(o), nil)
+	})
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// }}}
+
+// download {{{
+
+type download struct {
+	store  *RemoteStore
+	object blobstore.Object
+	pos    int64
+	end    int64
+	hash   hash.Hash
+	body   io.ReadCloser
+}
+
+func (d *download) connect() error {
+	resp, err := d.store.do(func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodGet, d.store.blobURL(d.object), nil)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case d.end >= 0:
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", d.pos, d.end-1))
+		case d.pos > 0:
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", d.pos))
+		}
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	if d.pos > 0 && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return fmt.Errorf("Server ignored our Range request for '%s'", d.object.Id())
+	}
+	d.body = resp.Body
+	return nil
+}
+
+func (d *download) Read(b []byte) (int, error) {
+	if d.end >= 0 && d.pos >= d.end {
+		return 0, io.EOF
+	}
+	for attempt := 1; ; attempt++ {
+		n, err := d.body.Read(b)
+		d.pos += int64(n)
+		if d.hash != nil {
+			d.hash.Write(b[:n])
+		}
+
+		if err == io.EOF {
+			if d.hash != nil && fmt.Sprintf("%x", d.hash.Sum(nil)) != d.object.Id() {
+				return n, blobstore.ObjectError{ID: d.object.Id(), Err: blobstore.ErrCorrupt}
+			}
+			return n, io.EOF
+		}
+		if err == nil || n > 0 || attempt >= d.store.attempts() {
+			return n, err
+		}
+
+		/* The connection dropped part way through; pick up from where
+		 * we got to. */
+		d.body.Close()
+		time.Sleep(d.store.backoff(attempt))
+		if cerr := d.connect(); cerr != nil {
+			return 0, cerr
+		}
+	}
+}
+
+func (d *download) Close() error {
+	return d.body.Close()
+}
+
+// }}}
+
+// request helpers {{{
+
+func (r *RemoteStore) blobURL(o blobstore.Object) string {
+	return r.URL + "/blobs/" + o.Id()
+}
+
+func (r *RemoteStore) attempts() int {
+	if r.Attempts < 1 {
+		return 1
+	}
+	return r.Attempts
+}
+
+func (r *RemoteStore) backoff(attempt int) time.Duration {
+	return r.Backoff << uint(attempt-1)
+}
+
+func (r *RemoteStore) client() *http.Client {
+	if r.Client == nil {
+		return http.DefaultClient
+	}
+	return r.Client
+}
+
+/* Send the request newRequest builds, retrying on network errors and 5xx
+ * responses. Any other non-2xx response is turned into an error. */
+func (r *RemoteStore) do(newRequest func() (*http.Request, error)) (*http.Response, error) {
+	var lastErr error
+	for attempt := 1; attempt <= r.attempts(); attempt++ {
+		if attempt > 1 {
+			time.Sleep(r.backoff(attempt - 1))
+		}
+
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		resp, err := r.client().Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return resp, nil
+		}
+
+		err = responseError(req, resp)
+		resp.Body.Close()
+		if resp.StatusCode < 500 {
+			return nil, err
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func responseError(req *http.Request, resp *http.Response) error {
+	message := resp.Status
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	errResp := ErrorResponse{}
+	if json.Unmarshal(bytes.TrimSpace(body), &errResp) == nil && errResp.Error != "" {
+		message = errResp.Error
+	}
+
+	id := req.URL.Path[strings.LastIndex(req.URL.Path, "/")+1:]
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return blobstore.ObjectError{ID: id, Err: blobstore.ErrNotFound}
+	case http.StatusConflict:
+		return fmt.Errorf("%w: %s", blobstore.ErrLocked, message)
+	case http.StatusBadRequest:
+		if strings.Contains(message, blobstore.ErrInvalidID.Error()) {
+			return fmt.Errorf("%w: %s", blobstore.ErrInvalidID, message)
+		}
+	}
+	return errors.New(message)
+}
+
+// }}}
+
+// vim: foldmethod=marker
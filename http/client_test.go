@@ -0,0 +1,78 @@
+package http
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"pault.ag/go/blobstore"
+)
+
+func newTestServer(t *testing.T) (*Handler, *RemoteStore) {
+	t.Helper()
+	h := newTestHandler(t)
+	h.MaxListLimit = 3
+	server := httptest.NewServer(h)
+	t.Cleanup(server.Close)
+	remote := NewRemoteStore(server.URL)
+	remote.Backoff = 0
+	return h, remote
+}
+
+func TestRemoteStore(t *testing.T) {
+	h, remote := newTestServer(t)
+
+	objects := []blobstore.Object{}
+	for _, content := range []string{"one", "two", "three", "four", "five"} {
+		o, err := remote.Put(strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !h.Store.Exists(*o) || !remote.Exists(*o) {
+			t.Fatalf("%s wasn't stored", content)
+		}
+		objects = append(objects, *o)
+	}
+
+	rc, err := remote.Open(objects[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil || string(data) != "three" {
+		t.Fatalf("read back %q, %v", data, err)
+	}
+	rc, err = remote.OpenRange(objects[2], 1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil || string(data) != "hre" {
+		t.Fatalf("read range %q, %v", data, err)
+	}
+
+	/* More than one page's worth. */
+	listed, err := remote.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != len(objects) {
+		t.Fatalf("listed %d of %d", len(listed), len(objects))
+	}
+
+	if err := remote.Remove(objects[0]); err != nil {
+		t.Fatal(err)
+	}
+	if remote.Exists(objects[0]) {
+		t.Fatal("removed object still exists")
+	}
+	if _, err := remote.Open(objects[0]); !errors.Is(err, blobstore.ErrNotFound) {
+		t.Fatalf("opening a removed object gave %v", err)
+	}
+}
+
+// vim: foldmethod=marker
@@ -0,0 +1,304 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"pault.ag/go/blobstore"
+)
+
+/* Handler serves a blobstore.Store over HTTP:
+ *
+ *   GET    /blobs/{id}   content of the blob, with Range support
+ *   HEAD   /blobs/{id}   the same, minus the body
+ *   PUT    /blobs/{id}   upload a blob, which must hash to {id}
+ *   POST   /blobs        upload a blob, whatever it hashes to
+ *   DELETE /blobs/{id}   remove a blob
+ *   GET    /blobs        list blobs, as JSON; takes prefix, after and limit
+ *   GET    /stat/{id}    information about a blob, as JSON
+ *   *      /v2/...       the OCI distribution blob API; see oci.go
+ *
+ * Blobs are immutable, so they're served with their id as the ETag, and
+ * cached forever. */
+type Handler struct {
+	Store *blobstore.Store
+
+	// Refuse PUT, POST and DELETE.
+	ReadOnly bool
+
+	// Largest page /blobs will return, and the default if no limit is
+	// given.
+	MaxListLimit int
+
+	uploadLock sync.Mutex
+	uploads    map[string]*ociUpload
+}
+
+type ListResponse struct {
+	Objects []string `json:"objects"`
+	Next    string   `json:"next,omitempty"`
+}
+
+type UploadResponse struct {
+	ID string `json:"id"`
+}
+
+type StatResponse struct {
+	ID         string `json:"id"`
+	Size       int64  `json:"size"`
+	StoredSize int64  `json:"stored_size"`
+	Codec      string `json:"codec,omitempty"`
+	KeyID      string `json:"key_id,omitempty"`
+	Packed     bool   `json:"packed"`
+	Chunks     int    `json:"chunks,omitempty"`
+}
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// New {{{
+
+func New(store *blobstore.Store) *Handler {
+	return &Handler{Store: store, MaxListLimit: 1000}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := r.URL.Path
+	switch {
+	case p == "/blobs":
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			h.list(w, r)
+		case http.MethodPost:
+			h.post(w, r)
+		default:
+			writeStatus(w, http.StatusMethodNotAllowed, "Method not allowed")
+		}
+	case strings.HasPrefix(p, "/blobs/"):
+		id := strings.TrimPrefix(p, "/blobs/")
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			h.get(w, r, id)
+		case http.MethodPut:
+			h.put(w, r, id)
+		case http.MethodDelete:
+			h.delete(w, r, id)
+		default:
+			writeStatus(w, http.StatusMethodNotAllowed, "Method not allowed")
+		}
+	case p == "/v2" || strings.HasPrefix(p, "/v2/"):
+		h.oci(w, r)
+	case strings.HasPrefix(p, "/stat/"):
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			h.stat(w, r, strings.TrimPrefix(p, "/stat/"))
+		default:
+			writeStatus(w, http.StatusMethodNotAllowed, "Method not allowed")
+		}
+	default:
+		writeStatus(w, http.StatusNotFound, "Not found")
+	}
+}
+
+// }}}
+
+// GET / HEAD {{{
+
+func (h *Handler) get(w http.ResponseWriter, r *http.Request, id string) {
+	obj, err := h.Store.ParseObject(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	reader, err := h.Store.OpenReader(obj)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer reader.Close()
+
+	w.Header().Set("ETag", fmt.Sprintf("\"%s\"", obj.Id()))
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", time.Time{}, reader)
+}
+
+// }}}
+
+// PUT / POST {{{
+
+func (h *Handler) put(w http.ResponseWriter, r *http.Request, id string) {
+	if h.ReadOnly {
+		writeStatus(w, http.StatusMethodNotAllowed, "Store is read-only")
+		return
+	}
+	want, err := h.Store.ParseObject(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if h.Store.Exists(want) {
+		/* Drain the upload, so the client sees our answer rather than a
+		 * reset connection. */
+		io.Copy(io.Discard, r.Body)
+		writeJSON(w, http.StatusOK, UploadResponse{ID: want.Id()})
+		return
+	}
+	h.upload(w, r, &want)
+}
+
+func (h *Handler) post(w http.ResponseWriter, r *http.Request) {
+	if h.ReadOnly {
+		writeStatus(w, http.StatusMethodNotAllowed, "Store is read-only")
+		return
+	}
+	h.upload(w, r, nil)
+}
+
+func (h *Handler) upload(w http.ResponseWriter, r *http.Request, want *blobstore.Object) {
+	writer, err := h.Store.Create()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if _, err := io.Copy(writer, r.Body); err != nil {
+		writer.Abort()
+		writeStatus(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if want != nil && writer.Id() != want.Id() {
+		writer.Abort()
+		writeStatus(w, http.StatusBadRequest, fmt.Sprintf(
+			"Content hashes to '%s', not '%s'", writer.Id(), want.Id(),
+		))
+		return
+	}
+	obj, err := h.Store.Commit(*writer)
+	if err != nil {
+		writer.Abort()
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Location", "/blobs/"+obj.Id())
+	writeJSON(w, http.StatusCreated, UploadResponse{ID: obj.Id()})
+}
+
+// }}}
+
+// DELETE {{{
+
+func (h *Handler) delete(w http.ResponseWriter, r *http.Request, id string) {
+	if h.ReadOnly {
+		writeStatus(w, http.StatusMethodNotAllowed, "Store is read-only")
+		return
+	}
+	obj, err := h.Store.ParseObject(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := h.Store.Remove(obj); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// }}}
+
+// list {{{
+
+func (h *Handler) list(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit := h.MaxListLimit
+	if l := query.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			writeStatus(w, http.StatusBadRequest, "Invalid limit")
+			return
+		}
+		if n < limit || limit <= 0 {
+			limit = n
+		}
+	}
+
+	objects, next, err := h.Store.ListPage(blobstore.ListOptions{
+		Prefix: query.Get("prefix"),
+		After:  query.Get("after"),
+	}, limit)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	resp := ListResponse{Objects: []string{}, Next: next}
+	for _, o := range objects {
+		resp.Objects = append(resp.Objects, o.Id())
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// }}}
+
+// stat {{{
+
+func (h *Handler) stat(w http.ResponseWriter, r *http.Request, id string) {
+	obj, err := h.Store.ParseObject(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	info, err := h.Store.Stat(obj)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, StatResponse{
+		ID:         info.Object.Id(),
+		Size:       info.Size,
+		StoredSize: info.StoredSize,
+		Codec:      info.Codec,
+		KeyID:      info.KeyID,
+		Packed:     info.Packed,
+		Chunks:     info.Chunks,
+	})
+}
+
+// }}}
+
+// helpers {{{
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeStatus(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, ErrorResponse{Error: message})
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, blobstore.ErrNotFound):
+		writeStatus(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, blobstore.ErrInvalidID):
+		writeStatus(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, blobstore.ErrLocked):
+		writeStatus(w, http.StatusConflict, err.Error())
+	default:
+		writeStatus(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,69 @@
+package http
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandlerPutMismatch(t *testing.T) {
+	h := newTestHandler(t)
+	o, err := h.Store.Put(strings.NewReader("expected"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Store.Remove(*o); err != nil {
+		t.Fatal(err)
+	}
+
+	w := serve(h, http.MethodPut, "/blobs/"+o.Id(), []byte("something else"))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("mismatched put gave %d", w.Code)
+	}
+	if h.Store.Exists(*o) {
+		t.Fatal("mismatched put committed")
+	}
+	if w := serve(h, http.MethodPut, "/blobs/"+o.Id(), []byte("expected")); w.Code != http.StatusCreated {
+		t.Fatalf("put gave %d", w.Code)
+	}
+}
+
+func TestHandlerReadOnly(t *testing.T) {
+	h := newTestHandler(t)
+	h.ReadOnly = true
+	for _, method := range []string{http.MethodPost, http.MethodDelete} {
+		target := "/blobs"
+		if method == http.MethodDelete {
+			target += "/" + strings.Repeat("0", 64)
+		}
+		if w := serve(h, method, target, []byte("content")); w.Code != http.StatusMethodNotAllowed {
+			t.Fatalf("%s on a read-only store gave %d", method, w.Code)
+		}
+	}
+}
+
+func TestHandlerGet(t *testing.T) {
+	h := newTestHandler(t)
+	o, err := h.Store.Put(bytes.NewReader([]byte("0123456789")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/blobs/"+o.Id(), nil)
+	r.Header.Set("Range", "bytes=2-4")
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusPartialContent || w.Body.String() != "234" {
+		t.Fatalf("range get gave %d: %q", w.Code, w.Body)
+	}
+	if w := serve(h, http.MethodGet, "/blobs/not-an-id", nil); w.Code != http.StatusBadRequest {
+		t.Fatalf("bad id gave %d", w.Code)
+	}
+	if w := serve(h, http.MethodGet, "/stat/"+o.Id(), nil); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"size":10`) {
+		t.Fatalf("stat gave %d: %s", w.Code, w.Body)
+	}
+}
+
+// vim: foldmethod=marker
@@ -0,0 +1,394 @@
+package http
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"pault.ag/go/blobstore"
+)
+
+/* The blob half of the OCI distribution API
+ * (https://github.com/opencontainers/distribution-spec/blob/main/spec.md),
+ * so container tooling can push and pull layers straight to the pool:
+ *
+ *   GET    /v2/                                 API version check
+ *   GET    /v2/<name>/blobs/<digest>            pull a blob (HEAD too)
+ *   DELETE /v2/<name>/blobs/<digest>            remove a blob
+ *   POST   /v2/<name>/blobs/uploads/            start an upload, or do it
+ *                                               all at once with ?digest=,
+ *                                               or ?mount= one we have
+ *   PATCH  /v2/<name>/blobs/uploads/<id>        send the next chunk
+ *   PUT    /v2/<name>/blobs/uploads/<id>        finish, with ?digest=
+ *   GET    /v2/<name>/blobs/uploads/<id>        how far an upload has got
+ *   DELETE /v2/<name>/blobs/uploads/<id>        give up on an upload
+ *
+ * There's one pool behind every repository name, so a blob pushed to one
+ * can be pulled from any. Pushed blobs are pinned, since nothing links
+ * them into the stage, so GC leaves them be until they're deleted.
+ * Manifests aren't served; this is content storage, not a registry. */
+
+type ociErrors struct {
+	Errors []ociError `json:"errors"`
+}
+
+type ociError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+/* An upload in progress; the Writer gets each chunk as it comes. */
+type ociUpload struct {
+	writer  *blobstore.Writer
+	size    int64
+	touched time.Time
+}
+
+// routing {{{
+
+func (h *Handler) oci(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+
+	p := strings.TrimPrefix(r.URL.Path, "/v2")
+	if p == "" || p == "/" {
+		writeJSON(w, http.StatusOK, struct{}{})
+		return
+	}
+
+	i := strings.LastIndex(p, "/blobs/")
+	if i < 0 {
+		if strings.Contains(p, "/manifests/") {
+			writeOCIError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "Manifests are not served here")
+			return
+		}
+		writeOCIError(w, http.StatusNotFound, "NAME_UNKNOWN", "Not found")
+		return
+	}
+	name, rest := strings.TrimPrefix(p[:i], "/"), p[i+len("/blobs/"):]
+	if name == "" {
+		writeOCIError(w, http.StatusNotFound, "NAME_INVALID", "No repository name")
+		return
+	}
+
+	switch {
+	case rest == "uploads" || rest == "uploads/":
+		if r.Method != http.MethodPost {
+			writeOCIError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "Method not allowed")
+			return
+		}
+		h.ociStartUpload(w, r, name)
+	case strings.HasPrefix(rest, "uploads/"):
+		id := strings.TrimPrefix(rest, "uploads/")
+		switch r.Method {
+		case http.MethodPatch:
+			h.ociPatchUpload(w, r, name, id)
+		case http.MethodPut:
+			h.ociFinishUpload(w, r, name, id)
+		case http.MethodGet:
+			h.ociUploadStatus(w, r, name, id)
+		case http.MethodDelete:
+			h.ociCancelUpload(w, r, id)
+		default:
+			writeOCIError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "Method not allowed")
+		}
+	default:
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			h.ociGetBlob(w, r, rest)
+		case http.MethodDelete:
+			h.ociDeleteBlob(w, r, rest)
+		default:
+			writeOCIError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "Method not allowed")
+		}
+	}
+}
+
+// }}}
+
+// blobs {{{
+
+func (h *Handler) ociGetBlob(w http.ResponseWriter, r *http.Request, digest string) {
+	obj, err := blobstore.ParseDigest(digest)
+	if err != nil {
+		writeOCIError(w, http.StatusBadRequest, "DIGEST_INVALID", err.Error())
+		return
+	}
+	reader, err := h.Store.OpenReader(obj)
+	if err != nil {
+		writeOCIStoreError(w, err)
+		return
+	}
+	defer reader.Close()
+
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.Header().Set("ETag", fmt.Sprintf("\"%s\"", digest))
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", time.Time{}, reader)
+}
+
+func (h *Handler) ociDeleteBlob(w http.ResponseWriter, r *http.Request, digest string) {
+	if h.ReadOnly {
+		writeOCIError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "Store is read-only")
+		return
+	}
+	obj, err := blobstore.ParseDigest(digest)
+	if err != nil {
+		writeOCIError(w, http.StatusBadRequest, "DIGEST_INVALID", err.Error())
+		return
+	}
+	if err := h.Store.Remove(obj); err != nil {
+		writeOCIStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// }}}
+
+// uploads {{{
+
+func (h *Handler) ociStartUpload(w http.ResponseWriter, r *http.Request, name string) {
+	if h.ReadOnly {
+		writeOCIError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "Store is read-only")
+		return
+	}
+	query := r.URL.Query()
+
+	if mount := query.Get("mount"); mount != "" {
+		/* Every repository shares the one pool, so if we have it, it's
+		 * already mounted. */
+		if obj, err := blobstore.ParseDigest(mount); err == nil && h.Store.Exists(obj) {
+			if err := h.Store.Pin(obj); err != nil {
+				writeOCIStoreError(w, err)
+				return
+			}
+			/* Unless GC got to it first, in which case it's a fresh
+			 * upload after all. */
+			if h.Store.Exists(obj) {
+				ociCreated(w, name, mount)
+				return
+			}
+		}
+	}
+
+	writer, err := h.Store.Create()
+	if err != nil {
+		writeOCIStoreError(w, err)
+		return
+	}
+	upload := &ociUpload{writer: writer, touched: time.Now()}
+
+	if digest := query.Get("digest"); digest != "" {
+		/* A monolithic upload: the whole blob is in this request. */
+		if _, err := io.Copy(writer, r.Body); err != nil {
+			writer.Abort()
+			writeOCIError(w, http.StatusBadRequest, "BLOB_UPLOAD_INVALID", err.Error())
+			return
+		}
+		h.ociCommit(w, name, upload, digest)
+		return
+	}
+
+	id, err := h.addUpload(upload)
+	if err != nil {
+		writer.Abort()
+		writeOCIStoreError(w, err)
+		return
+	}
+	ociAccepted(w, http.StatusAccepted, name, id, 0)
+}
+
+func (h *Handler) ociPatchUpload(w http.ResponseWriter, r *http.Request, name, id string) {
+	upload := h.takeUpload(id)
+	if upload == nil {
+		writeOCIError(w, http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN", "No such upload")
+		return
+	}
+
+	if cr := r.Header.Get("Content-Range"); cr != "" {
+		start, err := strconv.ParseInt(strings.SplitN(cr, "-", 2)[0], 10, 64)
+		if err != nil || start != upload.size {
+			h.putUpload(id, upload)
+			ociAccepted(w, http.StatusRequestedRangeNotSatisfiable, name, id, upload.size)
+			return
+		}
+	}
+	n, err := io.Copy(upload.writer, r.Body)
+	upload.size += n
+	if err != nil {
+		/* There's no telling how much of the chunk made it in, so the
+		 * upload can't be picked up again. */
+		upload.writer.Abort()
+		writeOCIError(w, http.StatusBadRequest, "BLOB_UPLOAD_INVALID", err.Error())
+		return
+	}
+	h.putUpload(id, upload)
+	ociAccepted(w, http.StatusAccepted, name, id, upload.size)
+}
+
+func (h *Handler) ociFinishUpload(w http.ResponseWriter, r *http.Request, name, id string) {
+	upload := h.takeUpload(id)
+	if upload == nil {
+		writeOCIError(w, http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN", "No such upload")
+		return
+	}
+	digest := r.URL.Query().Get("digest")
+	if digest == "" {
+		h.putUpload(id, upload)
+		writeOCIError(w, http.StatusBadRequest, "DIGEST_INVALID", "No digest given")
+		return
+	}
+	/* The last chunk can come along with the PUT. */
+	n, err := io.Copy(upload.writer, r.Body)
+	upload.size += n
+	if err != nil {
+		upload.writer.Abort()
+		writeOCIError(w, http.StatusBadRequest, "BLOB_UPLOAD_INVALID", err.Error())
+		return
+	}
+	h.ociCommit(w, name, upload, digest)
+}
+
+func (h *Handler) ociUploadStatus(w http.ResponseWriter, r *http.Request, name, id string) {
+	upload := h.takeUpload(id)
+	if upload == nil {
+		writeOCIError(w, http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN", "No such upload")
+		return
+	}
+	size := upload.size
+	h.putUpload(id, upload)
+	ociAccepted(w, http.StatusNoContent, name, id, size)
+}
+
+func (h *Handler) ociCancelUpload(w http.ResponseWriter, r *http.Request, id string) {
+	upload := h.takeUpload(id)
+	if upload == nil {
+		writeOCIError(w, http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN", "No such upload")
+		return
+	}
+	upload.writer.Abort()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/* Check the finished upload against digest, and commit and pin it if it
+ * matches. Either way, the upload is done with. */
+func (h *Handler) ociCommit(w http.ResponseWriter, name string, upload *ociUpload, digest string) {
+	if "sha256:"+upload.writer.Id() != digest {
+		upload.writer.Abort()
+		writeOCIError(w, http.StatusBadRequest, "DIGEST_INVALID", fmt.Sprintf(
+			"Content hashes to 'sha256:%s', not '%s'", upload.writer.Id(), digest,
+		))
+		return
+	}
+	obj, err := blobstore.ParseDigest(digest)
+	if err != nil {
+		upload.writer.Abort()
+		writeOCIError(w, http.StatusBadRequest, "DIGEST_INVALID", err.Error())
+		return
+	}
+	if err := h.Store.Pin(obj); err != nil {
+		upload.writer.Abort()
+		writeOCIStoreError(w, err)
+		return
+	}
+	if _, err := h.Store.Commit(*upload.writer); err != nil {
+		upload.writer.Abort()
+		h.Store.Unpin(obj)
+		writeOCIStoreError(w, err)
+		return
+	}
+	ociCreated(w, name, digest)
+}
+
+// }}}
+
+// upload sessions {{{
+
+/* Uploads nobody has touched in this long are thrown away. */
+const ociUploadTimeout = time.Hour
+
+func (h *Handler) addUpload(upload *ociUpload) (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(buf)
+	h.putUpload(id, upload)
+	return id, nil
+}
+
+/* Take the upload out of the table while a request works on it, so two
+ * requests can't write to it at once. */
+func (h *Handler) takeUpload(id string) *ociUpload {
+	h.uploadLock.Lock()
+	defer h.uploadLock.Unlock()
+	upload := h.uploads[id]
+	delete(h.uploads, id)
+	return upload
+}
+
+func (h *Handler) putUpload(id string, upload *ociUpload) {
+	h.uploadLock.Lock()
+	defer h.uploadLock.Unlock()
+	if h.uploads == nil {
+		h.uploads = map[string]*ociUpload{}
+	}
+	now := time.Now()
+	for oldID, old := range h.uploads {
+		if now.Sub(old.touched) > ociUploadTimeout {
+			old.writer.Abort()
+			delete(h.uploads, oldID)
+		}
+	}
+	upload.touched = now
+	h.uploads[id] = upload
+}
+
+// }}}
+
+// helpers {{{
+
+func ociAccepted(w http.ResponseWriter, status int, name, id string, size int64) {
+	w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s", name, id))
+	w.Header().Set("Docker-Upload-UUID", id)
+	if size > 0 {
+		w.Header().Set("Range", fmt.Sprintf("0-%d", size-1))
+	} else {
+		w.Header().Set("Range", "0-0")
+	}
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(status)
+}
+
+func ociCreated(w http.ResponseWriter, name, digest string) {
+	w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", name, digest))
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(http.StatusCreated)
+}
+
+func writeOCIError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, ociErrors{Errors: []ociError{{Code: code, Message: message}}})
+}
+
+func writeOCIStoreError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, blobstore.ErrNotFound):
+		writeOCIError(w, http.StatusNotFound, "BLOB_UNKNOWN", err.Error())
+	case errors.Is(err, blobstore.ErrInvalidID):
+		writeOCIError(w, http.StatusBadRequest, "DIGEST_INVALID", err.Error())
+	default:
+		writeOCIError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+	}
+}
+
+// }}}
+
+// vim: foldmethod=marker
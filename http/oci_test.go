@@ -0,0 +1,102 @@
+package http
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"pault.ag/go/blobstore"
+)
+
+func newTestHandler(t *testing.T) *Handler {
+	t.Helper()
+	store, err := blobstore.Init(t.TempDir(), blobstore.InitOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(store)
+}
+
+func serve(h *Handler, method, target string, body []byte) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, target, bytes.NewReader(body)))
+	return w
+}
+
+func TestOCIPush(t *testing.T) {
+	h := newTestHandler(t)
+	content := []byte("a layer")
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(content))
+
+	w := serve(h, http.MethodPost, "/v2/repo/blobs/uploads/", nil)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("start gave %d", w.Code)
+	}
+	location := w.Header().Get("Location")
+	if w := serve(h, http.MethodPatch, location, content[:3]); w.Code != http.StatusAccepted {
+		t.Fatalf("patch gave %d", w.Code)
+	}
+	if w := serve(h, http.MethodPut, location+"?digest="+digest, content[3:]); w.Code != http.StatusCreated {
+		t.Fatalf("finish gave %d: %s", w.Code, w.Body)
+	}
+
+	/* Nothing links it, but GC has to leave it be. */
+	if err := h.Store.GC(blobstore.DumbGarbageCollector{}); err != nil {
+		t.Fatal(err)
+	}
+	w = serve(h, http.MethodGet, "/v2/other/blobs/"+digest, nil)
+	if w.Code != http.StatusOK || w.Body.String() != string(content) {
+		t.Fatalf("pull gave %d: %q", w.Code, w.Body)
+	}
+
+	if w := serve(h, http.MethodDelete, "/v2/repo/blobs/"+digest, nil); w.Code != http.StatusAccepted {
+		t.Fatalf("delete gave %d", w.Code)
+	}
+	if w := serve(h, http.MethodGet, "/v2/repo/blobs/"+digest, nil); w.Code != http.StatusNotFound {
+		t.Fatalf("pull after delete gave %d", w.Code)
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestOCIPatchFailure(t *testing.T) {
+	h := newTestHandler(t)
+	w := serve(h, http.MethodPost, "/v2/repo/blobs/uploads/", nil)
+	location := w.Header().Get("Location")
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPatch, location, failingReader{}))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("failed patch gave %d", w.Code)
+	}
+	if w := serve(h, http.MethodGet, location, nil); w.Code != http.StatusNotFound {
+		t.Fatalf("upload outlived a failed patch: %d", w.Code)
+	}
+}
+
+func TestOCIDigestMismatch(t *testing.T) {
+	h := newTestHandler(t)
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("expected")))
+	w := serve(h, http.MethodPost, "/v2/repo/blobs/uploads/?digest="+digest, []byte("something else"))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "DIGEST_INVALID") {
+		t.Fatalf("mismatched push gave %d: %s", w.Code, w.Body)
+	}
+	objects, err := h.Store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 0 {
+		t.Fatalf("mismatched push committed %v", objects)
+	}
+}
+
+// vim: foldmethod=marker
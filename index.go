@@ -0,0 +1,264 @@
+package blobstore
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+/* The index is a reverse mapping of Object to the stage paths that link to
+ * it. It lives under indexRoot, sharded the same way as the blobs, with one
+ * file per linked Object containing one stage-relative path per line.
+ *
+ * Link and Unlink keep it up to date, under the same lock Reindex holds,
+ * so their updates don't race each other or land in an index that Reindex
+ * is about to replace. Anything that touches the stage behind our back
+ * will make it go stale, and Reindex will rebuild it from a full walk of
+ * the stage. */
+
+// Reindex {{{
+
+func (s Store) Reindex() error {
+	unlock, err := s.lockWait(context.Background(), "index")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	seen := map[Object][]string{}
+	err = s.LinkedVisitor(func(obj Object, p string, info os.FileInfo) error {
+		rel, err := s.stageRelPath(p)
+		if err != nil {
+			return err
+		}
+		seen[obj] = append(seen[obj], rel)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	indexPath := path.Join(s.root, s.indexRoot)
+	newPath := indexPath + ".new"
+	if err := os.RemoveAll(newPath); err != nil {
+		return err
+	}
+
+	for obj, paths := range seen {
+		if err := writeIndexFile(path.Join(newPath, s.objShardPath(obj)), paths); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(newPath, 0755); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(indexPath); err != nil {
+		return err
+	}
+	return os.Rename(newPath, indexPath)
+}
+
+// }}}
+
+// Indexed {{{
+
+func (s Store) Indexed() bool {
+	fi, err := os.Stat(path.Join(s.root, s.indexRoot))
+	return err == nil && fi.IsDir()
+}
+
+// }}}
+
+// LinkedPaths {{{
+
+func (s Store) LinkedPaths(o Object) ([]string, error) {
+	if err := s.validObject(o); err != nil {
+		return nil, err
+	}
+	if !s.Indexed() {
+		linked, err := s.Linked()
+		if err != nil {
+			return nil, err
+		}
+		return linked[o], nil
+	}
+
+	rels, err := readIndexFile(s.objToIndexPath(o))
+	if err != nil {
+		return nil, err
+	}
+	ret := []string{}
+	for _, rel := range rels {
+		ret = append(ret, s.qualifyStagePath(rel))
+	}
+	return ret, nil
+}
+
+// }}}
+
+// index helpers {{{
+
+func (s Store) indexVisitor(ctx context.Context, progn func(Object, string) error) error {
+	indexPath := path.Join(s.root, s.indexRoot)
+	return filepath.Walk(indexPath, func(p string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if f.IsDir() {
+			return nil
+		}
+		_, hash := path.Split(p)
+		obj, err := s.ParseObject(hash)
+		if err != nil {
+			/* Probably a temporary file left over from a crash */
+			return nil
+		}
+		rels, err := readIndexFile(p)
+		if err != nil {
+			return err
+		}
+		for _, rel := range rels {
+			if err := progn(obj, s.qualifyStagePath(rel)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+/* Take the index lock for an update to the stage that's already been
+ * made, returning a nil unlock if there's no index to update. */
+func (s Store) lockIndex() (func() error, error) {
+	/* A Reindex that starts after this will see the change in its walk,
+	 * so it's only one already under way that needs waiting for. */
+	if !s.Indexed() && !s.locked("index") {
+		return nil, nil
+	}
+	unlock, err := s.lockWait(context.Background(), "index")
+	if err != nil {
+		return nil, err
+	}
+	if !s.Indexed() {
+		unlock()
+		return nil, nil
+	}
+	return unlock, nil
+}
+
+func (s Store) indexAdd(o Object, stagePath string) error {
+	unlock, err := s.lockIndex()
+	if err != nil || unlock == nil {
+		return err
+	}
+	defer unlock()
+	rel, err := s.stageRelPath(stagePath)
+	if err != nil {
+		return err
+	}
+	indexPath := s.objToIndexPath(o)
+	rels, err := readIndexFile(indexPath)
+	if err != nil {
+		return err
+	}
+	for _, el := range rels {
+		if el == rel {
+			return nil
+		}
+	}
+	return writeIndexFile(indexPath, append(rels, rel))
+}
+
+func (s Store) indexRemove(o Object, stagePath string) error {
+	unlock, err := s.lockIndex()
+	if err != nil || unlock == nil {
+		return err
+	}
+	defer unlock()
+	rel, err := s.stageRelPath(stagePath)
+	if err != nil {
+		return err
+	}
+	indexPath := s.objToIndexPath(o)
+	rels, err := readIndexFile(indexPath)
+	if err != nil {
+		return err
+	}
+	ret := []string{}
+	for _, el := range rels {
+		if el != rel {
+			ret = append(ret, el)
+		}
+	}
+	if len(ret) == 0 {
+		if err := os.Remove(indexPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return writeIndexFile(indexPath, ret)
+}
+
+func (s Store) objToIndexPath(o Object) string {
+	return path.Join(s.root, s.indexRoot, s.objShardPath(o))
+}
+
+func (s Store) stageRelPath(p string) (string, error) {
+	return filepath.Rel(path.Join(s.root, s.stageRoot), p)
+}
+
+func readIndexFile(p string) ([]string, error) {
+	fd, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	ret := []string{}
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			ret = append(ret, line)
+		}
+	}
+	return ret, scanner.Err()
+}
+
+func writeIndexFile(p string, rels []string) error {
+	dir := path.Dir(p)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	sort.Strings(rels)
+
+	fd, err := ioutil.TempFile(dir, "index")
+	if err != nil {
+		return err
+	}
+	if _, err := fd.WriteString(strings.Join(rels, "\n") + "\n"); err != nil {
+		fd.Close()
+		os.Remove(fd.Name())
+		return err
+	}
+	if err := fd.Close(); err != nil {
+		os.Remove(fd.Name())
+		return err
+	}
+	return os.Rename(fd.Name(), p)
+}
+
+// }}}
+
+// vim: foldmethod=marker
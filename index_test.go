@@ -0,0 +1,113 @@
+package blobstore
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func linkedPaths(t *testing.T, store *Store, o Object) []string {
+	t.Helper()
+	paths, err := store.LinkedPaths(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func TestIndex(t *testing.T) {
+	store, err := Init(t.TempDir(), InitOptions{Index: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !store.Indexed() {
+		t.Fatal("store isn't indexed")
+	}
+	o := putString(t, store, "indexed")
+	for _, p := range []string{"a", "dir/b"} {
+		if err := store.Link(o, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{path.Join(store.root, "a"), path.Join(store.root, "dir/b")}
+	if got := linkedPaths(t, store, o); len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("linked at %v, wanted %v", got, want)
+	}
+
+	if err := store.Unlink("a"); err != nil {
+		t.Fatal(err)
+	}
+	if got := linkedPaths(t, store, o); len(got) != 1 || got[0] != want[1] {
+		t.Fatalf("linked at %v after unlink", got)
+	}
+
+	/* Behind the index's back; it's stale until a Reindex. */
+	if err := os.Remove(path.Join(store.root, "dir/b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(store.objToPath(o), path.Join(store.root, "c")); err != nil {
+		t.Fatal(err)
+	}
+	if got := linkedPaths(t, store, o); len(got) != 1 || got[0] != want[1] {
+		t.Fatalf("index changed by itself: %v", got)
+	}
+	if err := store.Reindex(); err != nil {
+		t.Fatal(err)
+	}
+	if got := linkedPaths(t, store, o); len(got) != 1 || got[0] != path.Join(store.root, "c") {
+		t.Fatalf("linked at %v after reindex", got)
+	}
+}
+
+/* Links to the one Object from many goroutines, with a Reindex going on
+ * at the same time, must all end up in the index; run with -race. */
+func TestIndexConcurrent(t *testing.T) {
+	store, err := Init(t.TempDir(), InitOptions{Index: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := putString(t, store, "linked from everywhere")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 9)
+	want := []string{}
+	for i := 0; i < 8; i++ {
+		for j := 0; j < 4; j++ {
+			want = append(want, path.Join(store.root, fmt.Sprintf("%d/%d", i, j)))
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 4; j++ {
+				if err := store.Link(o, fmt.Sprintf("%d/%d", i, j)); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := store.Reindex(); err != nil {
+			errs <- err
+		}
+	}()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	sort.Strings(want)
+	got := linkedPaths(t, store, o)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("linked at %v, wanted %v", got, want)
+	}
+}
+
+// vim: foldmethod=marker
@@ -0,0 +1,213 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"sync"
+)
+
+type IngestOptions struct {
+	// Number of files to commit at once. Anything less than one means one
+	// per CPU.
+	Workers int
+
+	// Hash every file and report what would happen, but don't commit or
+	// link anything.
+	DryRun bool
+
+	// Called after each file is dealt with, from whichever worker dealt
+	// with it.
+	Progress func(IngestProgress)
+}
+
+type IngestProgress struct {
+	// Stage path of the file, and the Object it is (or would be) linked
+	// to.
+	Path   string
+	Object Object
+	Bytes  int64
+
+	// Set if the file was left alone, with ErrChanged or ErrFileMode
+	// saying why.
+	Err error
+
+	// Running totals across the whole ingest.
+	Done  int
+	Total int
+}
+
+type IngestResult struct {
+	// Files committed and replaced with links (or that would be, for a
+	// dry run), and their total size.
+	Files int
+	Bytes int64
+
+	// Files that were already links into this store, from an earlier
+	// ingest or otherwise.
+	Linked int
+
+	// Distinct Objects the files turned into.
+	Objects int
+
+	// Files left alone, by path, with ErrChanged or ErrFileMode saying
+	// why.
+	Skipped []StageError
+}
+
+// Ingest {{{
+
+func (s Store) Ingest(dir string, opts IngestOptions) (IngestResult, error) {
+	return s.IngestContext(context.Background(), dir, opts)
+}
+
+/* Commit every regular file under dir (relative to the stage, like Link)
+ * and replace each one with a link to its blob.
+ *
+ * Files are swapped for their link with a rename, so every path is always
+ * either the original file or the link. Anything that's already a link
+ * into the store is left be, so an ingest that was interrupted can just be
+ * run again.
+ *
+ * Some files are left alone, and listed in the result's Skipped rather
+ * than failing the whole ingest: those that change while they're being
+ * read (ErrChanged), and those whose mode isn't blobMode (ErrFileMode).
+ * Links have no permissions of their own, and blobs are shared, so there's
+ * no way to keep a file's mode once it's a link; chmod those first. */
+func (s Store) IngestContext(ctx context.Context, dir string, opts IngestOptions) (IngestResult, error) {
+	result := IngestResult{}
+	files := []string{}
+
+	err := s.stageWalk(ctx, s.qualifyStagePath(dir), func(p string, info os.FileInfo) error {
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err := os.Readlink(p); err == nil && s.isStorePath(link) {
+				result.Linked++
+			}
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			files = append(files, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+
+	lock := sync.Mutex{}
+	seen := map[Object]bool{}
+	done := 0
+
+	err = forEach(ctx, WalkOptions{Workers: opts.Workers}.workers(), len(files), func(ctx context.Context, i int) error {
+		o, n, err := s.ingestFile(ctx, files[i], opts.DryRun)
+		skipped := StageError{}
+		if err != nil && !(errors.As(err, &skipped) && (errors.Is(err, ErrChanged) || errors.Is(err, ErrFileMode))) {
+			return err
+		}
+
+		lock.Lock()
+		if err != nil {
+			result.Skipped = append(result.Skipped, skipped)
+		} else {
+			result.Files++
+			result.Bytes += n
+			seen[o] = true
+		}
+		done++
+		progress := IngestProgress{Path: files[i], Object: o, Bytes: n, Err: err, Done: done, Total: len(files)}
+		lock.Unlock()
+
+		if opts.Progress != nil {
+			opts.Progress(progress)
+		}
+		return nil
+	})
+	result.Objects = len(seen)
+	sort.Slice(result.Skipped, func(i, j int) bool {
+		return result.Skipped[i].Path < result.Skipped[j].Path
+	})
+	return result, err
+}
+
+func (s Store) ingestFile(ctx context.Context, p string, dryRun bool) (Object, int64, error) {
+	fd, err := os.Open(p)
+	if err != nil {
+		return Object{}, 0, err
+	}
+	defer fd.Close()
+	before, err := fd.Stat()
+	if err != nil {
+		return Object{}, 0, err
+	}
+	if before.Mode().Perm() != blobMode {
+		return Object{}, 0, StageError{Path: p, Err: ErrFileMode}
+	}
+
+	var (
+		o Object
+		n int64
+	)
+	if dryRun {
+		hash := s.objectIDHasher()
+		if n, err = io.Copy(hash, contextReader{ctx: ctx, r: fd}); err != nil {
+			return Object{}, n, err
+		}
+		o = Object{id: fmt.Sprintf("%x", hash.Sum(nil))}
+	} else {
+		w, err := s.Create()
+		if err != nil {
+			return Object{}, 0, err
+		}
+		if n, err = io.Copy(w, contextReader{ctx: ctx, r: fd}); err != nil {
+			w.Abort()
+			return Object{}, n, err
+		}
+		obj, err := s.Commit(*w)
+		if err != nil {
+			return Object{}, n, err
+		}
+		o = *obj
+	}
+
+	after, err := os.Stat(p)
+	if err != nil {
+		return o, n, err
+	}
+	if !os.SameFile(before, after) || after.Size() != n || !after.ModTime().Equal(before.ModTime()) {
+		return o, n, StageError{Path: p, Err: ErrChanged}
+	}
+	if dryRun {
+		return o, n, nil
+	}
+	return o, n, s.ingestLink(o, p)
+}
+
+/* Swap the file at stagePath for a link to o. */
+func (s Store) ingestLink(o Object, stagePath string) error {
+	target, err := s.linkTarget(o)
+	if err != nil {
+		return err
+	}
+
+	tmp := path.Join(path.Dir(stagePath), fmt.Sprintf(".%s.ingest", path.Base(stagePath)))
+	os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, stagePath); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := s.indexAdd(o, stagePath); err != nil {
+		return err
+	}
+	return s.keepLinkTarget(o, target)
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,73 @@
+package blobstore
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestIngest(t *testing.T) {
+	store := newTestStore(t)
+	dir := path.Join(store.root, "stage")
+	if err := os.MkdirAll(path.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, mode := range map[string]os.FileMode{
+		"plain":      0644,
+		"sub/plain":  0644,
+		"private":    0600,
+		"executable": 0755,
+	} {
+		p := path.Join(dir, name)
+		if err := ioutil.WriteFile(p, []byte("content of "+path.Base(name)), mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(p, mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result, err := store.Ingest("stage", IngestOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Files != 2 || result.Objects != 1 {
+		t.Fatalf("ingested %d files as %d objects", result.Files, result.Objects)
+	}
+	if len(result.Skipped) != 2 {
+		t.Fatalf("skipped %v", result.Skipped)
+	}
+	for _, skip := range result.Skipped {
+		if !errors.Is(skip, ErrFileMode) {
+			t.Fatalf("skipped %s with %s", skip.Path, skip.Err)
+		}
+	}
+
+	for name, link := range map[string]bool{
+		"plain":      true,
+		"sub/plain":  true,
+		"private":    false,
+		"executable": false,
+	} {
+		info, err := os.Lstat(path.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.Mode()&os.ModeSymlink != 0; got != link {
+			t.Fatalf("%s: link %t, wanted %t", name, got, link)
+		}
+	}
+
+	/* Run again, and everything already done is left be. */
+	result, err = store.Ingest("stage", IngestOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Files != 0 || result.Linked != 2 {
+		t.Fatalf("second ingest did %d files, saw %d linked", result.Files, result.Linked)
+	}
+}
+
+// vim: foldmethod=marker
@@ -0,0 +1,160 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"iter"
+	"os"
+	"path"
+	"strings"
+)
+
+var errStopList = errors.New("blobstore: stop listing")
+
+type ListOptions struct {
+	// Only visit Objects whose id starts with Prefix.
+	Prefix string
+
+	// Only visit Objects whose id sorts strictly after After. This is the
+	// cursor returned by ListPage.
+	After string
+}
+
+// ListVisitor {{{
+
+func (s Store) ListVisitor(opts ListOptions, progn func(Object) error) error {
+	return s.ListVisitorContext(context.Background(), opts, progn)
+}
+
+func (s Store) ListVisitorContext(ctx context.Context, opts ListOptions, progn func(Object) error) error {
+	visit, flush, err := s.mergePacked(opts, progn)
+	if err != nil {
+		return err
+	}
+
+	flushOld := func() error { return nil }
+	if s.oldShard != nil {
+		/* Part way through a Reshard, some blobs are still where the old
+		 * layout put them. Anything in both places is only visited once. */
+		old := []Object{}
+		err := s.listDir(ctx, path.Join(s.root, s.blobRoot), s.oldShard, 0, "", opts, func(o Object) error {
+			old = append(old, o)
+			return nil
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		visit, flushOld = mergeSorted(old, visit)
+	}
+
+	err = s.listDir(ctx, path.Join(s.root, s.blobRoot), s.shard, 0, "", opts, visit)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := flushOld(); err != nil {
+		return err
+	}
+	return flush()
+}
+
+/* Visit the Objects under dir, which is depth levels into the shard layout
+ * and whose directory names spell out soFar. Entries that don't fit the
+ * layout (wrong width, or a file where a directory should be) are skipped,
+ * so two layouts can share blobRoot during a Reshard. */
+func (s Store) listDir(ctx context.Context, dir string, layout []int, depth int, soFar string, opts ListOptions, progn func(Object) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if depth > 0 && os.IsNotExist(err) {
+			/* Someone removed the shard out from under us; nothing to
+			 * see here. */
+			return nil
+		}
+		return err
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+
+		if depth < len(layout) {
+			if !entry.IsDir() || len(name) != layout[depth] {
+				continue
+			}
+			acc := soFar + name
+			if !prefixCompatible(acc, opts.Prefix) {
+				continue
+			}
+			if opts.After != "" && len(opts.After) >= len(acc) && acc < opts.After[:len(acc)] {
+				continue
+			}
+			if err := s.listDir(ctx, path.Join(dir, name), layout, depth+1, acc, opts, progn); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if entry.IsDir() || s.validObject(Object{id: name}) != nil {
+			continue
+		}
+		if !strings.HasPrefix(name, opts.Prefix) || name <= opts.After {
+			continue
+		}
+		if err := progn(Object{id: name}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func prefixCompatible(a, b string) bool {
+	return strings.HasPrefix(a, b) || strings.HasPrefix(b, a)
+}
+
+// }}}
+
+// ListPage {{{
+
+func (s Store) ListPage(opts ListOptions, limit int) ([]Object, string, error) {
+	ret := []Object{}
+	err := s.ListVisitor(opts, func(o Object) error {
+		if limit > 0 && len(ret) >= limit {
+			return errStopList
+		}
+		ret = append(ret, o)
+		return nil
+	})
+	if err != nil && err != errStopList {
+		return nil, "", err
+	}
+
+	if err != errStopList || len(ret) == 0 {
+		/* We ran off the end of the store, so there's no next page. */
+		return ret, "", nil
+	}
+	return ret, ret[len(ret)-1].Id(), nil
+}
+
+// }}}
+
+// Objects {{{
+
+func (s Store) Objects(opts ListOptions) iter.Seq2[Object, error] {
+	return func(yield func(Object, error) bool) {
+		err := s.ListVisitor(opts, func(o Object) error {
+			if !yield(o, nil) {
+				return errStopList
+			}
+			return nil
+		})
+		if err != nil && err != errStopList {
+			yield(Object{}, err)
+		}
+	}
+}
+
+// }}}
+
+// vim: foldmethod=marker
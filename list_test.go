@@ -0,0 +1,107 @@
+package blobstore
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func putMany(t *testing.T, store *Store, n int) []string {
+	t.Helper()
+	ids := []string{}
+	for i := 0; i < n; i++ {
+		ids = append(ids, putString(t, store, fmt.Sprintf("object %d", i)).Id())
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestListPrefix(t *testing.T) {
+	store := newTestStore(t)
+	ids := putMany(t, store, 50)
+
+	for _, prefix := range []string{ids[0][:1], ids[10][:2], ids[20][:6], ids[30]} {
+		want := []string{}
+		for _, id := range ids {
+			if strings.HasPrefix(id, prefix) {
+				want = append(want, id)
+			}
+		}
+		got := []string{}
+		err := store.ListVisitor(ListOptions{Prefix: prefix}, func(o Object) error {
+			got = append(got, o.Id())
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Fatalf("prefix %s: %v, wanted %v", prefix, got, want)
+		}
+	}
+}
+
+func TestListPage(t *testing.T) {
+	store := newTestStore(t)
+	ids := putMany(t, store, 23)
+
+	got := []string{}
+	after := ""
+	for pages := 0; ; pages++ {
+		if pages > len(ids) {
+			t.Fatal("paging never ended")
+		}
+		page, next, err := store.ListPage(ListOptions{After: after}, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, o := range page {
+			got = append(got, o.Id())
+		}
+		if next == "" {
+			break
+		}
+		after = next
+	}
+	if strings.Join(got, ",") != strings.Join(ids, ",") {
+		t.Fatalf("paged through %v, wanted %v", got, ids)
+	}
+
+	/* After is strict, and needn't be an id in the store. */
+	page, _, err := store.ListPage(ListOptions{After: ids[3]}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 1 || page[0].Id() != ids[4] {
+		t.Fatalf("page after %s was %v", ids[3], page)
+	}
+	page, _, err = store.ListPage(ListOptions{After: ids[3] + "0"}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 1 || page[0].Id() != ids[4] {
+		t.Fatalf("page after a non-id was %v", page)
+	}
+}
+
+func TestObjectsIterator(t *testing.T) {
+	store := newTestStore(t)
+	ids := putMany(t, store, 10)
+
+	got := []string{}
+	for o, err := range store.Objects(ListOptions{}) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, o.Id())
+		if len(got) == 3 {
+			break
+		}
+	}
+	if strings.Join(got, ",") != strings.Join(ids[:3], ",") {
+		t.Fatalf("iterated %v, wanted %v", got, ids[:3])
+	}
+}
+
+// vim: foldmethod=marker
@@ -0,0 +1,156 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"time"
+)
+
+/* Store-wide operations that can't safely run twice at once (GC, Pack,
+ * Reindex, Reshard, Migrate) take an exclusive lock file under .blobs. The
+ * lock file holds the host name and pid of whoever has it, and they touch
+ * it every lockRefresh for as long as they do.
+ *
+ * A lock left behind by a crash is stale, and the next taker breaks it,
+ * once its process is gone (if it was on this host), or once nobody has
+ * touched it for staleLockAge (wherever it was). */
+const (
+	lockRefresh  = 30 * time.Second
+	lockPoll     = 100 * time.Millisecond
+	staleLockAge = 5 * time.Minute
+)
+
+// lock {{{
+
+func (s Store) lock(name string) (func() error, error) {
+	lockPath := s.lockPath(name)
+	if err := os.MkdirAll(path.Dir(lockPath), 0755); err != nil {
+		return nil, err
+	}
+
+	fd, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if os.IsExist(err) && breakStaleLock(lockPath) {
+		fd, err = os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	}
+	if os.IsExist(err) {
+		return nil, StageError{Path: lockPath, Err: ErrLocked}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fd.WriteString(lockOwner()); err != nil {
+		fd.Close()
+		os.Remove(lockPath)
+		return nil, err
+	}
+	if err := fd.Close(); err != nil {
+		os.Remove(lockPath)
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(lockRefresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				os.Chtimes(lockPath, now, now)
+			}
+		}
+	}()
+	return func() error {
+		close(done)
+		return os.Remove(lockPath)
+	}, nil
+}
+
+/* Like lock, but wait for whoever has it to be done, rather than failing
+ * with ErrLocked. */
+func (s Store) lockWait(ctx context.Context, name string) (func() error, error) {
+	for {
+		unlock, err := s.lock(name)
+		if !errors.Is(err, ErrLocked) {
+			return unlock, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(lockPoll):
+		}
+	}
+}
+
+/* Whether anyone has the lock name right now. */
+func (s Store) locked(name string) bool {
+	_, err := os.Stat(s.lockPath(name))
+	return err == nil
+}
+
+func (s Store) lockPath(name string) string {
+	return path.Join(s.root, path.Dir(s.blobRoot), name+".lock")
+}
+
+func lockOwner() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s %d\n", host, os.Getpid())
+}
+
+/* Remove the lock file at p if it's stale, returning whether it's gone. */
+func breakStaleLock(p string) bool {
+	info, err := os.Stat(p)
+	if err != nil {
+		return os.IsNotExist(err)
+	}
+	owner, err := ioutil.ReadFile(p)
+	if err != nil || !lockStale(string(owner), info.ModTime()) {
+		return false
+	}
+
+	/* Someone else may have broken it and taken it in the meantime; only
+	 * remove it if it's still the one we looked at. */
+	again, err := os.Stat(p)
+	if err != nil || !os.SameFile(info, again) || !again.ModTime().Equal(info.ModTime()) {
+		return false
+	}
+	return os.Remove(p) == nil
+}
+
+func lockStale(owner string, touched time.Time) bool {
+	if time.Since(touched) > staleLockAge {
+		return true
+	}
+	var (
+		host string
+		pid  int
+	)
+	if _, err := fmt.Sscanf(owner, "%s %d", &host, &pid); err != nil {
+		/* Half written, most likely; it'll go stale by age soon enough
+		 * if its owner died. */
+		return false
+	}
+	if current, _ := os.Hostname(); host != current {
+		return false
+	}
+	return !processAlive(pid)
+}
+
+func processAlive(pid int) bool {
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = proc.Signal(syscall.Signal(0))
+	return !errors.Is(err, os.ErrProcessDone) && !errors.Is(err, syscall.ESRCH)
+}
+
+// }}}
+
+// vim: foldmethod=marker
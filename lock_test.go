@@ -0,0 +1,80 @@
+package blobstore
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestLockExclusive(t *testing.T) {
+	store := newTestStore(t)
+	unlock, err := store.lock("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.lock("test"); !errors.Is(err, ErrLocked) {
+		t.Fatalf("second lock: %v", err)
+	}
+	if err := unlock(); err != nil {
+		t.Fatal(err)
+	}
+	unlock, err = store.lock("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+}
+
+func TestLockStale(t *testing.T) {
+	store := newTestStore(t)
+	lockPath := path.Join(store.root, ".blobs", "test.lock")
+	host, _ := os.Hostname()
+
+	/* A process that's been and gone. */
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Skip(err)
+	}
+	dead := fmt.Sprintf("%s %d\n", host, cmd.Process.Pid)
+	if err := ioutil.WriteFile(lockPath, []byte(dead), 0644); err != nil {
+		t.Fatal(err)
+	}
+	unlock, err := store.lock("test")
+	if err != nil {
+		t.Fatalf("lock held by a dead process: %v", err)
+	}
+	unlock()
+
+	/* Someone on another host, who stopped touching it long ago. */
+	if err := ioutil.WriteFile(lockPath, []byte("elsewhere 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.lock("test"); !errors.Is(err, ErrLocked) {
+		t.Fatalf("fresh lock from another host: %v", err)
+	}
+	old := time.Now().Add(-2 * staleLockAge)
+	if err := os.Chtimes(lockPath, old, old); err != nil {
+		t.Fatal(err)
+	}
+	unlock, err = store.lock("test")
+	if err != nil {
+		t.Fatalf("abandoned lock: %v", err)
+	}
+	unlock()
+
+	/* And one that's very much alive. */
+	live := fmt.Sprintf("%s %d\n", host, os.Getpid())
+	if err := ioutil.WriteFile(lockPath, []byte(live), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.lock("test"); !errors.Is(err, ErrLocked) {
+		t.Fatalf("live lock: %v", err)
+	}
+}
+
+// vim: foldmethod=marker
@@ -1,5 +1,11 @@
 package blobstore
 
+import (
+	"fmt"
+
+	"crypto/sha256"
+)
+
 type Object struct {
 	id string
 }
@@ -8,4 +14,49 @@ func (o Object) Id() string {
 	return o.id
 }
 
+// ParseObject {{{
+
+func (s Store) ParseObject(id string) (Object, error) {
+	return parseObject(id, s.idLength())
+}
+
+/* Parse an id for the default (SHA256) object id hash, for code that has no
+ * Store to hand, such as a client for a remote one. */
+func ParseObject(id string) (Object, error) {
+	return parseObject(id, sha256.Size*2)
+}
+
+func parseObject(id string, length int) (Object, error) {
+	if len(id) != length {
+		return Object{}, InvalidIDError{
+			ID:     id,
+			Reason: fmt.Sprintf("expected %d characters, got %d", length, len(id)),
+		}
+	}
+	if !isHex(id) {
+		return Object{}, InvalidIDError{ID: id, Reason: "not a lowercase hex string"}
+	}
+	return Object{id: id}, nil
+}
+
+func (s Store) validObject(o Object) error {
+	_, err := s.ParseObject(o.Id())
+	return err
+}
+
+func (s Store) idLength() int {
+	return s.objectIDHasher().Size() * 2
+}
+
+func isHex(id string) bool {
+	for _, c := range id {
+		if !('0' <= c && c <= '9') && !('a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// }}}
+
 // vim: foldmethod=marker
@@ -0,0 +1,242 @@
+package blobstore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+/* An OCILayout is a directory in the stage laid out as an OCI image layout
+ * (https://github.com/opencontainers/image-spec/blob/main/image-layout.md):
+ *
+ *   oci-layout           {"imageLayoutVersion": "1.0.0"}
+ *   index.json           the OCIIndex of manifests
+ *   blobs/sha256/<hex>   content, by digest
+ *
+ * Each blob is a link into the Store, so the directory can be handed to
+ * any tool that reads OCI layouts (skopeo, oras, containerd...) as-is, and
+ * an image shares its layers with everything else in the pool. Anything a
+ * tool writes into blobs/sha256 is taken into the store by Sync. */
+type OCILayout struct {
+	store Store
+	dir   string
+}
+
+const (
+	ociLayoutFile    = "oci-layout"
+	ociIndexFile     = "index.json"
+	ociBlobDir       = "blobs/sha256"
+	ociLayoutVersion = "1.0.0"
+	ociIndexType     = "application/vnd.oci.image.index.v1+json"
+)
+
+type OCIDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type OCIIndex struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	Manifests     []OCIDescriptor   `json:"manifests"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// Digests {{{
+
+/* The OCI digest of o, such as "sha256:2cf24dba...". */
+func Digest(o Object) string {
+	return "sha256:" + o.Id()
+}
+
+func ParseDigest(digest string) (Object, error) {
+	if !strings.HasPrefix(digest, "sha256:") {
+		return Object{}, InvalidIDError{ID: digest, Reason: "not a sha256 digest"}
+	}
+	return ParseObject(strings.TrimPrefix(digest, "sha256:"))
+}
+
+// }}}
+
+// OCILayout {{{
+
+/* Open the OCI layout at dir (relative to the stage, like Link), creating
+ * its oci-layout and an empty index.json if it doesn't have them yet. */
+func (s Store) OCILayout(dir string) (*OCILayout, error) {
+	l := &OCILayout{store: s, dir: dir}
+	root := s.qualifyStagePath(dir)
+	if err := os.MkdirAll(path.Join(root, ociBlobDir), 0755); err != nil {
+		return nil, err
+	}
+
+	layoutPath := path.Join(root, ociLayoutFile)
+	data, err := ioutil.ReadFile(layoutPath)
+	switch {
+	case os.IsNotExist(err):
+		err := writeJSONFile(layoutPath, map[string]string{"imageLayoutVersion": ociLayoutVersion})
+		if err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	default:
+		layout := struct {
+			Version string `json:"imageLayoutVersion"`
+		}{}
+		if err := json.Unmarshal(data, &layout); err != nil {
+			return nil, StageError{Path: layoutPath, Err: err}
+		}
+		if layout.Version != ociLayoutVersion {
+			return nil, StageError{Path: layoutPath, Err: fmt.Errorf(
+				"%w: OCI layout %s", ErrUnsupportedVersion, layout.Version,
+			)}
+		}
+	}
+
+	if _, err := os.Stat(path.Join(root, ociIndexFile)); os.IsNotExist(err) {
+		if err := l.SetIndex(OCIIndex{}); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func (l *OCILayout) blobPath(o Object) string {
+	return path.Join(l.dir, ociBlobDir, o.Id())
+}
+
+// }}}
+
+// Blobs {{{
+
+/* Commit the content read from r, and link it into the layout. If digest
+ * isn't empty, the content has to match it. */
+func (l *OCILayout) PutBlob(r io.Reader, mediaType, digest string) (OCIDescriptor, error) {
+	w, err := l.store.Create()
+	if err != nil {
+		return OCIDescriptor{}, err
+	}
+	n, err := io.Copy(w, r)
+	if err != nil {
+		w.Abort()
+		return OCIDescriptor{}, err
+	}
+	if digest != "" && "sha256:"+w.Id() != digest {
+		w.Abort()
+		return OCIDescriptor{}, ObjectError{ID: digest, Err: ErrCorrupt}
+	}
+	o, err := l.store.Commit(*w)
+	if err != nil {
+		return OCIDescriptor{}, err
+	}
+	if err := l.store.Link(*o, l.blobPath(*o)); err != nil {
+		return OCIDescriptor{}, err
+	}
+	return OCIDescriptor{MediaType: mediaType, Digest: Digest(*o), Size: n}, nil
+}
+
+/* Link an Object already in the store into the layout. */
+func (l *OCILayout) LinkBlob(o Object) error {
+	return l.store.Link(o, l.blobPath(o))
+}
+
+func (l *OCILayout) OpenBlob(digest string) (io.ReadCloser, error) {
+	o, err := ParseDigest(digest)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Lstat(l.store.qualifyStagePath(l.blobPath(o))); err != nil {
+		return nil, ObjectError{ID: digest, Err: ErrNotFound}
+	}
+	return l.store.Open(o)
+}
+
+/* Take anything a tool wrote straight into blobs/sha256 into the store,
+ * checking it matches its name, and replace it with a link. Files that
+ * don't match are left where they are, and reported with ErrCorrupt. */
+func (l *OCILayout) Sync(ctx context.Context) error {
+	blobDir := l.store.qualifyStagePath(path.Join(l.dir, ociBlobDir))
+	entries, err := ioutil.ReadDir(blobDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.Mode().IsRegular() {
+			continue
+		}
+		p := path.Join(blobDir, entry.Name())
+		o, _, err := l.store.ingestFile(ctx, p, true)
+		if err != nil {
+			return err
+		}
+		if o.Id() != entry.Name() {
+			return StageError{Path: p, Err: ErrCorrupt}
+		}
+		if _, _, err := l.store.ingestFile(ctx, p, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// }}}
+
+// Index {{{
+
+func (l *OCILayout) Index() (OCIIndex, error) {
+	index := OCIIndex{}
+	p := l.store.qualifyStagePath(path.Join(l.dir, ociIndexFile))
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return index, err
+	}
+	if err := json.Unmarshal(data, &index); err != nil {
+		return index, StageError{Path: p, Err: err}
+	}
+	return index, nil
+}
+
+func (l *OCILayout) SetIndex(index OCIIndex) error {
+	index.SchemaVersion = 2
+	index.MediaType = ociIndexType
+	if index.Manifests == nil {
+		index.Manifests = []OCIDescriptor{}
+	}
+	return writeJSONFile(l.store.qualifyStagePath(path.Join(l.dir, ociIndexFile)), index)
+}
+
+/* Add desc, which must already be in the layout, to index.json. A
+ * manifest with the same digest is replaced. */
+func (l *OCILayout) AddManifest(desc OCIDescriptor) error {
+	o, err := ParseDigest(desc.Digest)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Lstat(l.store.qualifyStagePath(l.blobPath(o))); err != nil {
+		return ObjectError{ID: desc.Digest, Err: ErrNotFound}
+	}
+
+	index, err := l.Index()
+	if err != nil {
+		return err
+	}
+	manifests := []OCIDescriptor{}
+	for _, m := range index.Manifests {
+		if m.Digest != desc.Digest {
+			manifests = append(manifests, m)
+		}
+	}
+	index.Manifests = append(manifests, desc)
+	return l.SetIndex(index)
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,531 @@
+package blobstore
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/* Small blobs can be moved out of the shard tree and into pack files under
+ * packRoot, to save on inodes and directory walks. Each pack is a pair of
+ * files: "<name>.pack", which is the on-disk bytes of each blob (codec
+ * headers and all) one after the other, and "<name>.idx", with one
+ * "<id> <offset> <length>" line per blob in the pack.
+ *
+ * A blob is only visible in a pack once its idx lists it, so idx files are
+ * always written last, and removing a packed blob only drops it from the
+ * idx. Repack reclaims the space those leave behind.
+ *
+ * Loose blobs win over packed ones if both exist. Links can only point at
+ * loose blobs, so Pack leaves linked blobs be, and linking a packed blob
+ * puts a loose copy of it back. */
+
+type packEntry struct {
+	pack   string
+	offset int64
+	length int64
+}
+
+type packCache struct {
+	lock      sync.Mutex
+	signature string
+	entries   map[Object]packEntry
+	sorted    []Object
+}
+
+// Pack {{{
+
+func (s Store) Pack(ctx context.Context, maxSize int64) error {
+	unlock, err := s.lock("pack")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	entries, _, err := s.packIndex()
+	if err != nil {
+		return err
+	}
+
+	/* Anything linked straight at its loose blob has to stay put, or we'd
+	 * break the link. */
+	pinned := map[Object]bool{}
+	linked, err := s.LinkedContext(ctx)
+	if err != nil {
+		return err
+	}
+	for obj, paths := range linked {
+		for _, p := range paths {
+			if link, err := os.Readlink(p); err == nil && path.Clean(link) == s.loosePath(obj) {
+				pinned[obj] = true
+			}
+		}
+	}
+
+	candidates := []Object{}
+	err = s.listDir(ctx, path.Join(s.root, s.blobRoot), s.shard, 0, "", ListOptions{}, func(o Object) error {
+		if _, ok := entries[o]; ok || pinned[o] {
+			return nil
+		}
+		fi, err := os.Stat(s.loosePath(o))
+		if err != nil {
+			return s.objectError(o, err)
+		}
+		if fi.Size() <= maxSize {
+			candidates = append(candidates, o)
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	if err := s.writePack(ctx, candidates); err != nil {
+		return err
+	}
+	for _, o := range candidates {
+		if err := os.Remove(s.loosePath(o)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	/* Anything linked while we were at it needs its loose blob back; see
+	 * keepLinkTarget. */
+	linked, err = s.LinkedContext(ctx)
+	if err != nil {
+		return err
+	}
+	for _, o := range candidates {
+		for _, p := range linked[o] {
+			if link, err := os.Readlink(p); err == nil && path.Clean(link) == s.objToPath(o) {
+				if _, err := s.unpack(o); err != nil {
+					return err
+				}
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// }}}
+
+// Repack {{{
+
+func (s Store) Repack(ctx context.Context) error {
+	unlock, err := s.lock("pack")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	entries, sorted, err := s.packIndex()
+	if err != nil {
+		return err
+	}
+
+	live := map[string]int64{}
+	keep := []Object{}
+	for _, o := range sorted {
+		entry := entries[o]
+		if _, err := os.Stat(s.loosePath(o)); err == nil {
+			/* There's a loose copy, which wins anyway. */
+			continue
+		}
+		live[entry.pack] += entry.length
+		keep = append(keep, o)
+	}
+
+	packs, err := s.packNames()
+	if err != nil {
+		return err
+	}
+	wasted := false
+	for _, name := range packs {
+		fi, err := os.Stat(path.Join(s.root, s.packRoot, name+".pack"))
+		if err != nil {
+			return err
+		}
+		if fi.Size() != live[name] {
+			wasted = true
+		}
+	}
+	if !wasted && len(packs) <= 1 {
+		return nil
+	}
+
+	if len(keep) > 0 {
+		if err := s.writePack(ctx, keep); err != nil {
+			return err
+		}
+	}
+	for _, name := range packs {
+		if err := s.removePack(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// }}}
+
+// pack helpers {{{
+
+func (s Store) packed(o Object) (packEntry, bool, error) {
+	entries, _, err := s.packIndex()
+	if err != nil {
+		return packEntry{}, false, err
+	}
+	entry, ok := entries[o]
+	return entry, ok, nil
+}
+
+/* Open the on-disk bytes of o, be it loose or packed. */
+func (s Store) openRaw(o Object) (io.ReadCloser, error) {
+	fd, err := os.Open(s.loosePath(o))
+	if err == nil {
+		return fd, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	entry, ok, err := s.packed(o)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ObjectError{ID: o.Id(), Err: ErrNotFound}
+	}
+	fd, err = os.Open(path.Join(s.root, s.packRoot, entry.pack+".pack"))
+	if err != nil {
+		return nil, s.objectError(o, err)
+	}
+	return codecReadCloser{
+		Reader:  io.NewSectionReader(fd, entry.offset, entry.length),
+		closers: []io.Closer{fd},
+	}, nil
+}
+
+/* Give o a loose blob again, if it's only in a pack, and return where it
+ * is. Repack will drop the packed copy. */
+func (s Store) unpack(o Object) (string, error) {
+	loose := s.loosePath(o)
+	if _, err := os.Stat(loose); err == nil {
+		return loose, nil
+	}
+
+	raw, err := s.openRaw(o)
+	if err != nil {
+		return "", s.objectError(o, err)
+	}
+	defer raw.Close()
+	dir := path.Join(s.root, s.tempRoot)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	fd, err := ioutil.TempFile(dir, "unpack")
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(fd, raw); err != nil {
+		fd.Close()
+		os.Remove(fd.Name())
+		return "", err
+	}
+	if err := fd.Close(); err != nil {
+		os.Remove(fd.Name())
+		return "", err
+	}
+	if err := s.commitFile(fd.Name(), o); err != nil {
+		os.Remove(fd.Name())
+		return "", err
+	}
+	return s.objToPath(o), nil
+}
+
+func (s Store) removePacked(o Object) error {
+	/* Wait out any Pack or Repack, rather than fail a GC because one
+	 * happens to be running. */
+	unlock, err := s.lockWait(context.Background(), "pack")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	entry, ok, err := s.packed(o)
+	if err != nil || !ok {
+		return err
+	}
+	idxPath := path.Join(s.root, s.packRoot, entry.pack+".idx")
+	idx, err := s.readPackIndex(idxPath)
+	if err != nil {
+		return err
+	}
+	delete(idx, o)
+	if len(idx) == 0 {
+		return s.removePack(entry.pack)
+	}
+	return s.writePackIndex(entry.pack, idx)
+}
+
+func (s Store) writePack(ctx context.Context, objects []Object) error {
+	dir := path.Join(s.root, s.packRoot)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	fd, err := ioutil.TempFile(dir, "pack-*.tmp")
+	if err != nil {
+		return err
+	}
+	name := strings.TrimSuffix(path.Base(fd.Name()), ".tmp")
+	abort := func(err error) error {
+		fd.Close()
+		os.Remove(fd.Name())
+		return err
+	}
+
+	idx := map[Object]packEntry{}
+	offset := int64(0)
+	for _, o := range objects {
+		if err := ctx.Err(); err != nil {
+			return abort(err)
+		}
+		raw, err := s.openRaw(o)
+		if err != nil {
+			return abort(err)
+		}
+		n, err := io.Copy(fd, raw)
+		raw.Close()
+		if err != nil {
+			return abort(err)
+		}
+		idx[o] = packEntry{pack: name, offset: offset, length: n}
+		offset += n
+	}
+	if err := fd.Sync(); err != nil {
+		return abort(err)
+	}
+	if err := fd.Close(); err != nil {
+		os.Remove(fd.Name())
+		return err
+	}
+	if err := os.Rename(fd.Name(), path.Join(dir, name+".pack")); err != nil {
+		os.Remove(fd.Name())
+		return err
+	}
+	return s.writePackIndex(name, idx)
+}
+
+func (s Store) writePackIndex(name string, idx map[Object]packEntry) error {
+	defer s.invalidatePackCache()
+
+	ids := []Object{}
+	for o := range idx {
+		ids = append(ids, o)
+	}
+	sortObjects(ids)
+
+	dir := path.Join(s.root, s.packRoot)
+	fd, err := ioutil.TempFile(dir, "idx-*.tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(fd)
+	for _, o := range ids {
+		fmt.Fprintf(w, "%s %d %d\n", o.Id(), idx[o].offset, idx[o].length)
+	}
+	if err := w.Flush(); err != nil {
+		fd.Close()
+		os.Remove(fd.Name())
+		return err
+	}
+	if err := fd.Close(); err != nil {
+		os.Remove(fd.Name())
+		return err
+	}
+	return os.Rename(fd.Name(), path.Join(dir, name+".idx"))
+}
+
+func (s Store) removePack(name string) error {
+	defer s.invalidatePackCache()
+
+	dir := path.Join(s.root, s.packRoot)
+	if err := os.Remove(path.Join(dir, name+".idx")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(path.Join(dir, name+".pack")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s Store) packNames() ([]string, error) {
+	entries, err := ioutil.ReadDir(path.Join(s.root, s.packRoot))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".idx") {
+			names = append(names, strings.TrimSuffix(entry.Name(), ".idx"))
+		}
+	}
+	return names, nil
+}
+
+/* Return every packed blob, and the same sorted by id. The result is
+ * cached until any of the idx files change. */
+func (s Store) packIndex() (map[Object]packEntry, []Object, error) {
+	dir := path.Join(s.root, s.packRoot)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	signature := ""
+	for _, fi := range files {
+		if strings.HasSuffix(fi.Name(), ".idx") {
+			signature += fmt.Sprintf("%s:%d:%d;", fi.Name(), fi.Size(), fi.ModTime().UnixNano())
+		}
+	}
+
+	cache := s.packs
+	if cache == nil {
+		cache = &packCache{}
+	}
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if cache.entries != nil && cache.signature == signature {
+		return cache.entries, cache.sorted, nil
+	}
+
+	entries := map[Object]packEntry{}
+	for _, fi := range files {
+		if !strings.HasSuffix(fi.Name(), ".idx") {
+			continue
+		}
+		idx, err := s.readPackIndex(path.Join(dir, fi.Name()))
+		if err != nil {
+			return nil, nil, err
+		}
+		for o, entry := range idx {
+			entries[o] = entry
+		}
+	}
+	sorted := make([]Object, 0, len(entries))
+	for o := range entries {
+		sorted = append(sorted, o)
+	}
+	sortObjects(sorted)
+
+	cache.signature = signature
+	cache.entries = entries
+	cache.sorted = sorted
+	return entries, sorted, nil
+}
+
+func (s Store) invalidatePackCache() {
+	if s.packs == nil {
+		return
+	}
+	s.packs.lock.Lock()
+	s.packs.entries = nil
+	s.packs.lock.Unlock()
+}
+
+func (s Store) readPackIndex(p string) (map[Object]packEntry, error) {
+	fd, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	name := strings.TrimSuffix(path.Base(p), ".idx")
+	idx := map[Object]packEntry{}
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			return nil, StageError{Path: p, Err: ErrCorrupt}
+		}
+		offset, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, StageError{Path: p, Err: ErrCorrupt}
+		}
+		length, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return nil, StageError{Path: p, Err: ErrCorrupt}
+		}
+		o, err := s.ParseObject(fields[0])
+		if err != nil {
+			return nil, StageError{Path: p, Err: err}
+		}
+		idx[o] = packEntry{pack: name, offset: offset, length: length}
+	}
+	return idx, scanner.Err()
+}
+
+/* Calls progn for every packed blob that matches opts, in order, ahead of
+ * each loose blob that sorts after it, so the combined listing stays
+ * sorted. The returned function flushes whatever is left at the end. */
+func (s Store) mergePacked(opts ListOptions, progn func(Object) error) (func(Object) error, func() error, error) {
+	_, sorted, err := s.packIndex()
+	if err != nil {
+		return nil, nil, err
+	}
+	pending := []Object{}
+	for _, o := range sorted {
+		if strings.HasPrefix(o.Id(), opts.Prefix) && o.Id() > opts.After {
+			pending = append(pending, o)
+		}
+	}
+	visit, flush := mergeSorted(pending, progn)
+	return visit, flush, nil
+}
+
+/* Interleave the sorted Objects in pending with those passed to the
+ * returned visit func, which must also come in sorted order, handing each
+ * distinct Object to progn once. flush hands over whatever's left. */
+func mergeSorted(pending []Object, progn func(Object) error) (func(Object) error, func() error) {
+	visit := func(o Object) error {
+		for len(pending) > 0 && pending[0].Id() <= o.Id() {
+			next := pending[0]
+			pending = pending[1:]
+			if next == o {
+				continue
+			}
+			if err := progn(next); err != nil {
+				return err
+			}
+		}
+		return progn(o)
+	}
+	flush := func() error {
+		for _, o := range pending {
+			if err := progn(o); err != nil {
+				return err
+			}
+		}
+		pending = nil
+		return nil
+	}
+	return visit, flush
+}
+
+// }}}
+
+// vim: foldmethod=marker
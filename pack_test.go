@@ -0,0 +1,168 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestPack(t *testing.T) {
+	store := newTestStore(t)
+	objects := map[Object]string{}
+	for i := 0; i < 50; i++ {
+		content := fmt.Sprintf("small object %d", i)
+		objects[putString(t, store, content)] = content
+	}
+	big := putString(t, store, string(make([]byte, 8192)))
+	linked := putString(t, store, "linked, so it stays loose")
+	if err := store.Link(linked, "keep"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Pack(context.Background(), 1024); err != nil {
+		t.Fatal(err)
+	}
+	for o, content := range objects {
+		if _, err := os.Stat(store.objToPath(o)); !os.IsNotExist(err) {
+			t.Fatalf("%s is still loose", o.Id())
+		}
+		if got := readString(t, store, o); got != content {
+			t.Fatalf("%s reads as %q", o.Id(), got)
+		}
+	}
+	for _, o := range []Object{big, linked} {
+		if _, err := os.Stat(store.objToPath(o)); err != nil {
+			t.Fatalf("%s was packed: %v", o.Id(), err)
+		}
+	}
+
+	listed, err := store.List()
+	if err != nil || len(listed) != len(objects)+2 {
+		t.Fatalf("listed %d objects, %v", len(listed), err)
+	}
+	for i := 1; i < len(listed); i++ {
+		if listed[i-1].Id() >= listed[i].Id() {
+			t.Fatal("listing isn't sorted")
+		}
+	}
+}
+
+func TestPackLink(t *testing.T) {
+	store := newTestStore(t)
+	o := putString(t, store, "packed, then linked")
+	if err := store.Pack(context.Background(), 1024); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Link(o, "a/b"); err != nil {
+		t.Fatal(err)
+	}
+
+	/* The link points at the loose blob, put back, not a copy. */
+	link, err := os.Readlink(store.qualifyStagePath("a/b"))
+	if err != nil || link != store.objToPath(o) {
+		t.Fatalf("link to %s, %v", link, err)
+	}
+	if _, err := os.Stat(path.Join(store.root, store.rawRoot)); !os.IsNotExist(err) {
+		t.Fatal("linking a packed object made a raw copy")
+	}
+	data, err := ioutil.ReadFile(store.qualifyStagePath("a/b"))
+	if err != nil || string(data) != "packed, then linked" {
+		t.Fatalf("%q, %v", data, err)
+	}
+
+	/* Now it's loose again, Repack drops it from the pack. */
+	if err := store.Repack(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := store.packed(o); ok {
+		t.Fatal("Repack kept the packed copy")
+	}
+}
+
+func TestPackRepack(t *testing.T) {
+	store := newTestStore(t)
+	objects := []Object{}
+	for i := 0; i < 20; i++ {
+		objects = append(objects, putString(t, store, fmt.Sprintf("object %d", i)))
+		if i%5 == 4 {
+			if err := store.Pack(context.Background(), 1024); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if names, _ := store.packNames(); len(names) != 4 {
+		t.Fatalf("%d packs", len(names))
+	}
+	for _, o := range objects[:10] {
+		if err := store.Remove(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := store.Repack(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if names, _ := store.packNames(); len(names) != 1 {
+		t.Fatalf("%d packs after Repack", len(names))
+	}
+	for i, o := range objects {
+		if store.Exists(o) != (i >= 10) {
+			t.Fatalf("object %d exists: %t", i, store.Exists(o))
+		}
+	}
+	if got := readString(t, store, objects[15]); got != "object 15" {
+		t.Fatal(got)
+	}
+}
+
+func TestPackRemoveWaits(t *testing.T) {
+	store := newTestStore(t)
+	o := putString(t, store, "packed")
+	if err := store.Pack(context.Background(), 1024); err != nil {
+		t.Fatal(err)
+	}
+
+	unlock, err := store.lock("pack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() { done <- store.Remove(o) }()
+	time.Sleep(3 * lockPoll)
+	select {
+	case err := <-done:
+		t.Fatalf("Remove didn't wait for the pack lock: %v", err)
+	default:
+	}
+	unlock()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if store.Exists(o) {
+		t.Fatal("object survived Remove")
+	}
+}
+
+func TestPackIndexInvalidID(t *testing.T) {
+	store := newTestStore(t)
+	putString(t, store, "packed")
+	if err := store.Pack(context.Background(), 1024); err != nil {
+		t.Fatal(err)
+	}
+	names, _ := store.packNames()
+	idx := path.Join(store.root, store.packRoot, names[0]+".idx")
+	if err := ioutil.WriteFile(idx, []byte("../../../etc/passwd 0 6\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	store.invalidatePackCache()
+	if _, err := store.List(); !errors.Is(err, ErrInvalidID) {
+		t.Fatalf("listing with a bad idx: %v", err)
+	}
+}
+
+// vim: foldmethod=marker
@@ -0,0 +1,88 @@
+package blobstore
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+/* Pins are Objects kept live without a link in the stage, for things like
+ * the OCI API that take blobs in with nowhere to link them. Each one is an
+ * empty file under pinRoot, named by id; DumbGarbageCollector counts them
+ * as linked, and Remove drops them. */
+const pinRoot = ".blobs/pins"
+
+// Pin {{{
+
+/* Keep o live, whether or not it's in the store yet. Pinning before the
+ * Commit, rather than after, leaves no moment where GC could take it. */
+func (s Store) Pin(o Object) error {
+	if err := s.validObject(o); err != nil {
+		return err
+	}
+	p := s.pinPath(o)
+	if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+		return err
+	}
+	fd, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	return fd.Close()
+}
+
+func (s Store) Unpin(o Object) error {
+	if err := s.validObject(o); err != nil {
+		return err
+	}
+	if err := os.Remove(s.pinPath(o)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s Store) Pinned() ([]Object, error) {
+	return s.PinnedContext(context.Background())
+}
+
+func (s Store) PinnedContext(ctx context.Context) ([]Object, error) {
+	ret := []Object{}
+	err := filepath.Walk(path.Join(s.root, pinRoot), func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		o, err := s.ParseObject(path.Base(p))
+		if err != nil {
+			return StageError{Path: p, Err: err}
+		}
+		ret = append(ret, o)
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	sortObjects(ret)
+	return ret, nil
+}
+
+func (s Store) isPinned(o Object) bool {
+	_, err := os.Stat(s.pinPath(o))
+	return err == nil
+}
+
+/* Pins always use the default layout, whatever the store's blobs use, so
+ * a Reshard has nothing to move. */
+func (s Store) pinPath(o Object) string {
+	return path.Join(s.root, pinRoot, shardPath(defaultShardLayout, o))
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,35 @@
+package blobstore
+
+import (
+	"testing"
+)
+
+func TestPin(t *testing.T) {
+	store := newTestStore(t)
+	pinned := putString(t, store, "pinned")
+	loose := putString(t, store, "loose")
+	if err := store.Pin(pinned); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := store.Collect(DumbGarbageCollector{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0] != loose {
+		t.Fatalf("GC removed %v", removed)
+	}
+
+	if err := store.Remove(pinned); err != nil {
+		t.Fatal(err)
+	}
+	pins, err := store.Pinned()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pins) != 0 {
+		t.Fatalf("pins left after Remove: %v", pins)
+	}
+}
+
+// vim: foldmethod=marker
@@ -0,0 +1,36 @@
+package blobstore
+
+import (
+	"io"
+)
+
+/* Pool is the set of operations shared by a local Store and remote ones
+ * (such as the client in the http package), so code can be pointed at
+ * either. */
+type Pool interface {
+	Exists(o Object) bool
+	Open(o Object) (io.ReadCloser, error)
+	Put(r io.Reader) (*Object, error)
+	ListVisitor(opts ListOptions, progn func(Object) error) error
+	Remove(o Object) error
+}
+
+var _ Pool = Store{}
+
+// Put {{{
+
+func (s Store) Put(r io.Reader) (*Object, error) {
+	w, err := s.Create()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Abort()
+		return nil, err
+	}
+	return s.Commit(*w)
+}
+
+// }}}
+
+// vim: foldmethod=marker
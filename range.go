@@ -0,0 +1,356 @@
+package blobstore
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+)
+
+/* ObjectReader gives random access to the content of an Object, whatever
+ * the layout it's stored in:
+ *
+ *  - Raw blobs (loose or packed) are read directly.
+ *  - Chunked blobs seek straight to the chunk holding the offset.
+ *  - Blobs behind a codec (compression, encryption) can't be seeked into,
+ *    so they're decoded from the start, and reopened on a backwards seek.
+ *    Their size comes from their codec header, where they have one.
+ *
+ * As io.ReaderAt requires, ReadAt is safe to call from many goroutines at
+ * once, though on a blob behind a codec they'll take turns.
+ */
+type ObjectReader struct {
+	at  objectReaderAt
+	pos int64
+}
+
+type objectReaderAt interface {
+	io.ReaderAt
+	io.Closer
+	Size() (int64, error)
+}
+
+// OpenReader {{{
+
+func (s Store) OpenReader(o Object) (*ObjectReader, error) {
+	if err := s.validObject(o); err != nil {
+		return nil, err
+	}
+	at, err := s.openReaderAt(o)
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectReader{at: at}, nil
+}
+
+// }}}
+
+// OpenRange {{{
+
+/* Open length bytes of o starting at offset. A negative length reads to
+ * the end of the Object. */
+func (s Store) OpenRange(o Object, offset, length int64) (io.ReadCloser, error) {
+	r, err := s.OpenReader(o)
+	if err != nil {
+		return nil, err
+	}
+	if length < 0 {
+		size, err := r.Size()
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		length = size - offset
+	}
+	if offset < 0 || length < 0 {
+		r.Close()
+		return nil, errors.New("Invalid range")
+	}
+	return codecReadCloser{
+		Reader:  io.NewSectionReader(r, offset, length),
+		closers: []io.Closer{r},
+	}, nil
+}
+
+// }}}
+
+// ObjectReader {{{
+
+func (r *ObjectReader) Read(b []byte) (int, error) {
+	n, err := r.at.ReadAt(b, r.pos)
+	r.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *ObjectReader) ReadAt(b []byte, off int64) (int, error) {
+	return r.at.ReadAt(b, off)
+}
+
+func (r *ObjectReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		size, err := r.at.Size()
+		if err != nil {
+			return 0, err
+		}
+		offset += size
+	default:
+		return 0, errors.New("Invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("Negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *ObjectReader) Size() (int64, error) {
+	return r.at.Size()
+}
+
+func (r *ObjectReader) Close() error {
+	return r.at.Close()
+}
+
+// }}}
+
+// readerAt implementations {{{
+
+func (s Store) openReaderAt(o Object) (objectReaderAt, error) {
+	var (
+		fd   *os.File
+		base int64
+		size int64
+		err  error
+	)
+
+	fd, err = os.Open(s.loosePath(o))
+	if err == nil {
+		fi, err := fd.Stat()
+		if err != nil {
+			fd.Close()
+			return nil, err
+		}
+		size = fi.Size()
+	} else if os.IsNotExist(err) {
+		entry, ok, err := s.packed(o)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, ObjectError{ID: o.Id(), Err: ErrNotFound}
+		}
+		if fd, err = os.Open(path.Join(s.root, s.packRoot, entry.pack+".pack")); err != nil {
+			return nil, s.objectError(o, err)
+		}
+		base, size = entry.offset, entry.length
+	} else {
+		return nil, err
+	}
+
+	name, contentSize, r, err := readSizedCodecHeader(io.NewSectionReader(fd, base, size))
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+
+	switch name {
+	case "":
+		return sectionReaderAt{SectionReader: io.NewSectionReader(fd, base, size), fd: fd}, nil
+	case (IdentityCodec{}).Name():
+		/* The content is whatever's after the header. */
+		if contentSize < 0 {
+			contentSize = size - int64(len(codecMagic)+len(name)+1)
+		}
+		if contentSize > size {
+			fd.Close()
+			return nil, ObjectError{ID: o.Id(), Err: ErrCorrupt}
+		}
+		return sectionReaderAt{SectionReader: io.NewSectionReader(fd, base+size-contentSize, contentSize), fd: fd}, nil
+	case recipeCodecName:
+		chunks, err := s.readRecipe(r)
+		fd.Close()
+		if err != nil {
+			return nil, err
+		}
+		return newRecipeReaderAt(s, chunks), nil
+	default:
+		fd.Close()
+		return &streamReaderAt{reopen: func() (io.ReadCloser, error) { return s.Open(o) }, size: contentSize}, nil
+	}
+}
+
+type sectionReaderAt struct {
+	*io.SectionReader
+	fd *os.File
+}
+
+func (s sectionReaderAt) Size() (int64, error) {
+	return s.SectionReader.Size(), nil
+}
+
+func (s sectionReaderAt) Close() error {
+	return s.fd.Close()
+}
+
+type recipeReaderAt struct {
+	store   Store
+	chunks  []Chunk
+	offsets []int64
+	size    int64
+
+	lock         sync.Mutex
+	current      objectReaderAt
+	currentIndex int
+}
+
+func newRecipeReaderAt(s Store, chunks []Chunk) *recipeReaderAt {
+	offsets := make([]int64, len(chunks))
+	size := int64(0)
+	for i, chunk := range chunks {
+		offsets[i] = size
+		size += chunk.Size
+	}
+	return &recipeReaderAt{store: s, chunks: chunks, offsets: offsets, size: size, currentIndex: -1}
+}
+
+func (r *recipeReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	read := 0
+	for read < len(b) {
+		pos := off + int64(read)
+		if pos >= r.size {
+			return read, io.EOF
+		}
+		i := sort.Search(len(r.offsets), func(i int) bool { return r.offsets[i] > pos }) - 1
+		if i != r.currentIndex {
+			if r.current != nil {
+				r.current.Close()
+				r.current = nil
+			}
+			at, err := r.store.openReaderAt(r.chunks[i].Object)
+			if err != nil {
+				return read, err
+			}
+			r.current, r.currentIndex = at, i
+		}
+		want := b[read:]
+		if left := r.chunks[i].Size - (pos - r.offsets[i]); int64(len(want)) > left {
+			want = want[:left]
+		}
+		n, err := r.current.ReadAt(want, pos-r.offsets[i])
+		read += n
+		if err != nil && err != io.EOF {
+			return read, err
+		}
+		if n < len(want) {
+			/* The chunk is shorter than the recipe says. */
+			return read, ErrCorrupt
+		}
+	}
+	return read, nil
+}
+
+func (r *recipeReaderAt) Size() (int64, error) {
+	return r.size, nil
+}
+
+func (r *recipeReaderAt) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.current == nil {
+		return nil
+	}
+	return r.current.Close()
+}
+
+type streamReaderAt struct {
+	reopen func() (io.ReadCloser, error)
+
+	lock    sync.Mutex
+	current io.ReadCloser
+	pos     int64
+	size    int64
+}
+
+func (r *streamReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.current == nil || off < r.pos {
+		if err := r.rewind(); err != nil {
+			return 0, err
+		}
+	}
+	if off > r.pos {
+		n, err := io.CopyN(ioutil.Discard, r.current, off-r.pos)
+		r.pos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := io.ReadFull(r.current, b)
+	r.pos += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (r *streamReaderAt) Size() (int64, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	/* Only blobs from before format version 3 don't say. */
+	if r.size >= 0 {
+		return r.size, nil
+	}
+	rc, err := r.reopen()
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	size, err := io.Copy(ioutil.Discard, rc)
+	if err != nil {
+		return 0, err
+	}
+	r.size = size
+	return size, nil
+}
+
+func (r *streamReaderAt) rewind() error {
+	if r.current != nil {
+		r.current.Close()
+		r.current = nil
+	}
+	rc, err := r.reopen()
+	if err != nil {
+		return err
+	}
+	r.current, r.pos = rc, 0
+	return nil
+}
+
+func (r *streamReaderAt) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.current == nil {
+		return nil
+	}
+	return r.current.Close()
+}
+
+// }}}
+
+// vim: foldmethod=marker
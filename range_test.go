@@ -0,0 +1,146 @@
+package blobstore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+func TestOpenRange(t *testing.T) {
+	store := newTestStore(t)
+	content := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(content)
+	o, err := store.Put(bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range [][2]int64{{0, 10}, {99990, 10}, {5000, 50000}, {99999, 100}} {
+		rc, err := store.OpenRange(*o, r[0], r[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		end := r[0] + r[1]
+		if end > int64(len(content)) {
+			end = int64(len(content))
+		}
+		if !bytes.Equal(got, content[r[0]:end]) {
+			t.Fatalf("range %d+%d didn't match", r[0], r[1])
+		}
+	}
+}
+
+/* ReadAt must be safe to call from many goroutines at once, whatever's
+ * behind it; run with -race. */
+func TestReadAtConcurrent(t *testing.T) {
+	content := make([]byte, 256*1024)
+	rand.New(rand.NewSource(2)).Read(content)
+
+	gzipped := newTestStore(t)
+	gzipped.SetCodec(GzipCodec{})
+	encrypted, _ := newEncryptedStore(t)
+	chunked := newTestStore(t)
+
+	for name, open := range map[string]func() (*Store, Object){
+		"gzip": func() (*Store, Object) {
+			o, err := gzipped.Put(bytes.NewReader(content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return gzipped, *o
+		},
+		"encrypted": func() (*Store, Object) {
+			o, err := encrypted.Put(bytes.NewReader(content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return encrypted, *o
+		},
+		"chunked": func() (*Store, Object) {
+			return chunked, putChunked(t, chunked, content)
+		},
+	} {
+		store, o := open()
+		reader, err := store.OpenReader(o)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 8)
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(seed int64) {
+				defer wg.Done()
+				rng := rand.New(rand.NewSource(seed))
+				buf := make([]byte, 4096)
+				for j := 0; j < 20; j++ {
+					off := rng.Int63n(int64(len(content) - len(buf)))
+					if _, err := reader.ReadAt(buf, off); err != nil {
+						errs <- err
+						return
+					}
+					if !bytes.Equal(buf, content[off:off+int64(len(buf))]) {
+						errs <- ObjectError{ID: o.Id(), Err: ErrCorrupt}
+						return
+					}
+				}
+			}(int64(i))
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if size, err := reader.Size(); err != nil || size != int64(len(content)) {
+			t.Fatalf("%s: size %d, %v", name, size, err)
+		}
+		reader.Close()
+	}
+}
+
+/* The size of a blob behind a codec comes from its header; it shouldn't
+ * need to decode the blob to find it. */
+func TestSizeFromHeader(t *testing.T) {
+	store := newTestStore(t)
+	store.SetCodec(GzipCodec{})
+	content := bytes.Repeat([]byte("compressible "), 10000)
+	o, err := store.Put(bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	/* Mangle everything after the header; if Size decoded, it'd fail. */
+	p := store.loosePath(*o)
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := bytes.IndexByte(data, '\n') + 1
+	for i := header; i < len(data); i++ {
+		data[i] = 0xff
+	}
+	if err := ioutil.WriteFile(p, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := store.Stat(*o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != int64(len(content)) {
+		t.Fatalf("size %d, wanted %d", info.Size, len(content))
+	}
+	if _, err := store.Copy(*o, ioutil.Discard); err == nil {
+		t.Fatal("reading a mangled blob worked")
+	}
+}
+
+// vim: foldmethod=marker
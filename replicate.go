@@ -0,0 +1,161 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+type ReplicateOptions struct {
+	// Number of Objects to copy at once. Anything less than one means one
+	// per CPU.
+	Workers int
+
+	// Called after each Object is dealt with, from whichever worker dealt
+	// with it.
+	Progress func(ReplicateProgress)
+}
+
+type ReplicateProgress struct {
+	Object Object
+
+	// True if dst already had the Object, and nothing was copied.
+	Skipped bool
+
+	// Bytes copied for this Object.
+	Bytes int64
+
+	// Running totals across the whole replication.
+	Done  int
+	Total int
+}
+
+// Replicate {{{
+
+/* Copy every one of objects that dst doesn't already have over from src,
+ * checking each arrives under the id it left with. */
+func Replicate(ctx context.Context, src, dst Pool, objects []Object, opts ReplicateOptions) error {
+	return replicate(ctx, src, dst, len(objects), opts, func(send func(Object) error) error {
+		for _, o := range objects {
+			if err := send(o); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+/* Replicate every Object in src, as it lists them; Total is zero in
+ * progress reports, since it isn't known until the end. */
+func ReplicateAll(ctx context.Context, src, dst Pool, opts ReplicateOptions) error {
+	return replicate(ctx, src, dst, 0, opts, func(send func(Object) error) error {
+		return src.ListVisitor(ListOptions{}, send)
+	})
+}
+
+/* Replicate only the Objects linked into the stage of the local Store
+ * stage; that is, pull exactly what that stage needs from src. */
+func ReplicateStage(ctx context.Context, stage Store, src, dst Pool, opts ReplicateOptions) error {
+	linked, err := stage.LinkedContext(ctx)
+	if err != nil {
+		return err
+	}
+	objects := []Object{}
+	for o := range linked {
+		objects = append(objects, o)
+	}
+	sortObjects(objects)
+	return Replicate(ctx, src, dst, objects, opts)
+}
+
+func replicate(ctx context.Context, src, dst Pool, total int, opts ReplicateOptions, feed func(func(Object) error) error) error {
+	lock := sync.Mutex{}
+	done := 0
+
+	return forEachObject(ctx, WalkOptions{Workers: opts.Workers}.workers(), feed, func(ctx context.Context, o Object) error {
+		progress := ReplicateProgress{Object: o, Total: total}
+
+		if dst.Exists(o) {
+			progress.Skipped = true
+		} else {
+			n, err := replicateObject(ctx, src, dst, o)
+			if err != nil {
+				return err
+			}
+			progress.Bytes = n
+		}
+
+		if opts.Progress != nil {
+			lock.Lock()
+			done++
+			progress.Done = done
+			lock.Unlock()
+			opts.Progress(progress)
+		}
+		return nil
+	})
+}
+
+func replicateObject(ctx context.Context, src, dst Pool, o Object) (int64, error) {
+	rc, err := src.Open(o)
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+
+	counter := &countingReader{r: contextReader{ctx: ctx, r: rc}}
+	switch store := dst.(type) {
+	case Store:
+		return counter.n, store.putVerified(o, counter)
+	case *Store:
+		return counter.n, store.putVerified(o, counter)
+	}
+
+	got, err := dst.Put(counter)
+	if err != nil {
+		return counter.n, err
+	}
+	if *got != o {
+		/* What src handed us doesn't hash to o, so src is corrupt; and
+		 * dst has no way to check before it takes it, so take it back. */
+		dst.Remove(*got)
+		return counter.n, ObjectError{ID: o.Id(), Err: ErrCorrupt}
+	}
+	return counter.n, nil
+}
+
+/* Like Put, but only commit the content if it hashes to o. */
+func (s Store) putVerified(o Object, r io.Reader) error {
+	w, err := s.Create()
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Abort()
+		return err
+	}
+	if w.Id() != o.Id() {
+		w.Abort()
+		return ObjectError{ID: o.Id(), Err: ErrCorrupt}
+	}
+	if _, err := s.Commit(*w); err != nil {
+		w.Abort()
+		return err
+	}
+	return nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,64 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"sync"
+	"testing"
+)
+
+func TestReplicateAll(t *testing.T) {
+	src, dst := newTestStore(t), newTestStore(t)
+	objects := []Object{}
+	for _, content := range []string{"one", "two", "three", "four"} {
+		objects = append(objects, putString(t, src, content))
+	}
+	putString(t, dst, "two")
+
+	lock := sync.Mutex{}
+	skipped := 0
+	err := ReplicateAll(context.Background(), src, dst, ReplicateOptions{
+		Workers: 2,
+		Progress: func(p ReplicateProgress) {
+			lock.Lock()
+			defer lock.Unlock()
+			if p.Skipped {
+				skipped++
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if skipped != 1 {
+		t.Fatalf("skipped %d, wanted 1", skipped)
+	}
+	for _, o := range objects {
+		if !dst.Exists(o) {
+			t.Fatalf("%s wasn't replicated", o.Id())
+		}
+	}
+}
+
+func TestReplicateCorrupt(t *testing.T) {
+	src, dst := newTestStore(t), newTestStore(t)
+	o := putString(t, src, "the real thing")
+	if err := ioutil.WriteFile(src.loosePath(o), []byte("an impostor"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err := Replicate(context.Background(), src, dst, []Object{o}, ReplicateOptions{})
+	if !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("replicating a corrupt blob gave %v", err)
+	}
+	objects, err := dst.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 0 {
+		t.Fatalf("corrupt blob was committed as %v", objects)
+	}
+}
+
+// vim: foldmethod=marker
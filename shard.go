@@ -0,0 +1,277 @@
+package blobstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/* Widths of each directory level used to shard blobs under blobRoot, such
+ * that an id of "abcdef0123..." lives at "a/b/cdef/abcdef0123...". Stores
+ * can pick their own layout at Init, and change it with Reshard. */
+var defaultShardLayout = []int{1, 1, 4}
+
+// Shard layouts {{{
+
+/* Parse a layout written as widths separated by slashes, such as "2/2", or
+ * "flat" for no sharding at all. */
+func ParseShardLayout(layout string) ([]int, error) {
+	if layout == "flat" || layout == "" {
+		return []int{}, nil
+	}
+	ret := []int{}
+	for _, part := range strings.Split(layout, "/") {
+		width, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid shard layout: '%s'", layout)
+		}
+		ret = append(ret, width)
+	}
+	if err := validShardLayout(ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func FormatShardLayout(layout []int) string {
+	if len(layout) == 0 {
+		return "flat"
+	}
+	parts := []string{}
+	for _, width := range layout {
+		parts = append(parts, strconv.Itoa(width))
+	}
+	return strings.Join(parts, "/")
+}
+
+func (s Store) ShardLayout() []int {
+	return append([]int{}, s.shard...)
+}
+
+func validShardLayout(layout []int) error {
+	total := 0
+	for _, width := range layout {
+		if width < 1 {
+			return fmt.Errorf("Invalid shard layout: '%s'", FormatShardLayout(layout))
+		}
+		total += width
+	}
+	/* Leave at least some of the id to tell blobs in a shard apart. */
+	if total >= sha256.Size*2 {
+		return fmt.Errorf("Invalid shard layout: '%s'", FormatShardLayout(layout))
+	}
+	return nil
+}
+
+func shardPath(layout []int, o Object) string {
+	id := o.Id()
+	parts := []string{}
+	offset := 0
+	for _, width := range layout {
+		parts = append(parts, id[offset:offset+width])
+		offset += width
+	}
+	return path.Join(append(parts, id)...)
+}
+
+func sameShardLayout(a, b []int) bool {
+	return FormatShardLayout(a) == FormatShardLayout(b)
+}
+
+// }}}
+
+// Reshard {{{
+
+/* Move every loose blob into layout, while the store stays in use.
+ *
+ * The new layout is recorded first, so new blobs land there straight
+ * away, and reads fall back to the old one for anything not yet moved.
+ * Each blob is hard linked into place, stage links are repointed, and only
+ * then is the old copy removed. If Reshard is interrupted, running it again
+ * with the same layout picks up where it left off.
+ *
+ * Other processes with the store open keep using the layout they loaded
+ * with; they should Load it again once this returns. */
+func (s *Store) Reshard(ctx context.Context, layout []int) error {
+	if err := validShardLayout(layout); err != nil {
+		return err
+	}
+	/* GC and Pack both remove blobs out from under us, so keep them out
+	 * until we're done. */
+	for _, name := range []string{"reshard", "gc", "pack"} {
+		unlock, err := s.lock(name)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	config, err := readConfig(s.root)
+	if err != nil {
+		return err
+	}
+	if config.Version != FormatVersion {
+		return StageError{Path: s.root, Err: fmt.Errorf("%w %d; migrate the store first", ErrUnsupportedVersion, config.Version)}
+	}
+	if config.Shard == nil {
+		config.Shard = defaultShardLayout
+	}
+
+	switch {
+	case config.PreviousShard != nil && !sameShardLayout(config.Shard, layout):
+		return fmt.Errorf(
+			"Reshard from '%s' to '%s' is still under way",
+			FormatShardLayout(config.PreviousShard), FormatShardLayout(config.Shard),
+		)
+	case config.PreviousShard == nil && sameShardLayout(config.Shard, layout):
+		return nil
+	case config.PreviousShard == nil:
+		config.PreviousShard, config.Shard = config.Shard, layout
+		if err := writeConfig(s.root, config); err != nil {
+			return err
+		}
+	}
+	s.shard, s.oldShard = config.Shard, config.PreviousShard
+
+	/* Anything committed by someone still on the old layout after this
+	 * pass is picked up by the last one. */
+	if err := s.reshardLinkBlobs(ctx); err != nil {
+		return err
+	}
+	if err := s.reshardRelink(ctx); err != nil {
+		return err
+	}
+	if err := s.reshardLinkBlobs(ctx); err != nil {
+		return err
+	}
+	if err := s.reshardRemoveOld(ctx); err != nil {
+		return err
+	}
+
+	config.PreviousShard = nil
+	if err := writeConfig(s.root, config); err != nil {
+		return err
+	}
+	s.oldShard = nil
+	return nil
+}
+
+/* Give every blob in the old layout a second name in the new one. */
+func (s Store) reshardLinkBlobs(ctx context.Context) error {
+	err := s.listDir(ctx, path.Join(s.root, s.blobRoot), s.oldShard, 0, "", ListOptions{}, func(o Object) error {
+		newPath := s.objToPath(o)
+		if _, err := os.Stat(newPath); err == nil {
+			return nil
+		}
+		if err := os.MkdirAll(path.Dir(newPath), 0755); err != nil {
+			return err
+		}
+		err := os.Link(s.qualifyBlobPath(shardPath(s.oldShard, o)), newPath)
+		if err != nil && !os.IsExist(err) {
+			return s.objectError(o, err)
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+/* Repoint stage links at the old layout to the new one. */
+func (s Store) reshardRelink(ctx context.Context) error {
+	return s.LinkedVisitorContext(ctx, func(o Object, p string, info os.FileInfo) error {
+		link, err := os.Readlink(p)
+		if err != nil {
+			return err
+		}
+		if path.Clean(link) != s.qualifyBlobPath(shardPath(s.oldShard, o)) {
+			return nil
+		}
+		/* Swap the link in with a rename, so there's no moment where
+		 * the stage path doesn't exist. */
+		tmp := path.Join(path.Dir(p), fmt.Sprintf(".%s.reshard", path.Base(p)))
+		os.Remove(tmp)
+		if err := os.Symlink(s.objToPath(o), tmp); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, p); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		return nil
+	})
+}
+
+/* Remove the old names of every blob, and any old layout shard directories
+ * that leaves empty. */
+func (s Store) reshardRemoveOld(ctx context.Context) error {
+	err := s.listDir(ctx, path.Join(s.root, s.blobRoot), s.oldShard, 0, "", ListOptions{}, func(o Object) error {
+		if _, err := os.Stat(s.objToPath(o)); err != nil {
+			return s.objectError(o, err)
+		}
+		oldPath := s.qualifyBlobPath(shardPath(s.oldShard, o))
+		if err := os.Remove(oldPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	/* Directories the new layout uses too are left be, empty or not; a
+	 * Commit may be about to put something in one. */
+	blobRoot := path.Join(s.root, s.blobRoot)
+	dirs := []string{}
+	err = filepath.Walk(blobRoot, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() || p == blobRoot {
+			return nil
+		}
+		rel, err := filepath.Rel(blobRoot, p)
+		if err != nil {
+			return err
+		}
+		if !isShardDir(s.oldShard, rel) {
+			return filepath.SkipDir
+		}
+		if !isShardDir(s.shard, rel) {
+			dirs = append(dirs, p)
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	/* Deepest first; only empty directories will actually go. */
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Remove(dirs[i])
+	}
+	return nil
+}
+
+/* Whether rel (relative to blobRoot) is a directory layout would have. */
+func isShardDir(layout []int, rel string) bool {
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	if len(parts) > len(layout) {
+		return false
+	}
+	for i, part := range parts {
+		if len(part) != layout[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,69 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestReshard(t *testing.T) {
+	store := newTestStore(t)
+	objects := []Object{}
+	for _, content := range []string{"one", "two", "three"} {
+		o := putString(t, store, content)
+		if err := store.Link(o, path.Join("stage", content)); err != nil {
+			t.Fatal(err)
+		}
+		objects = append(objects, o)
+	}
+
+	/* A directory the new layout uses, that a Commit has only just made. */
+	fresh := path.Join(store.root, store.blobRoot, "ff")
+	if err := os.MkdirAll(fresh, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Reshard(context.Background(), []int{2}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Fatalf("reshard removed a new layout directory: %s", err)
+	}
+
+	reloaded, err := Load(store.root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, content := range []string{"one", "two", "three"} {
+		if got := readString(t, reloaded, objects[i]); got != content {
+			t.Fatalf("read back %q, wanted %q", got, content)
+		}
+		if _, err := os.Stat(reloaded.objToPath(objects[i])); err != nil {
+			t.Fatalf("blob isn't in the new layout: %s", err)
+		}
+		if _, err := os.Stat(path.Join(store.root, "stage", content)); err != nil {
+			t.Fatalf("stage link broken by reshard: %s", err)
+		}
+		old := store.qualifyBlobPath(shardPath(defaultShardLayout, objects[i]))
+		if _, err := os.Stat(old); !os.IsNotExist(err) {
+			t.Fatalf("old blob path left behind: %v", err)
+		}
+	}
+}
+
+func TestReshardLocked(t *testing.T) {
+	store := newTestStore(t)
+	unlock, err := store.lock("gc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+
+	if err := store.Reshard(context.Background(), []int{2}); !errors.Is(err, ErrLocked) {
+		t.Fatalf("reshard during gc gave %v", err)
+	}
+}
+
+// vim: foldmethod=marker
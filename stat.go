@@ -0,0 +1,80 @@
+package blobstore
+
+import (
+	"os"
+)
+
+type ObjectInfo struct {
+	Object Object
+
+	// Size of the content of the Object.
+	Size int64
+
+	// Size of the Object as stored on disk, codec headers and all. For
+	// chunked Objects, this is only the size of the recipe.
+	StoredSize int64
+
+	// Name of the codec the Object is stored with, if any, and the id of
+	// the key it's encrypted with, if it is.
+	Codec string
+	KeyID string
+
+	Packed bool
+	Chunks int
+}
+
+// Stat {{{
+
+func (s Store) Stat(o Object) (ObjectInfo, error) {
+	info := ObjectInfo{Object: o}
+	if err := s.validObject(o); err != nil {
+		return info, err
+	}
+
+	if fi, err := os.Stat(s.loosePath(o)); err == nil {
+		info.StoredSize = fi.Size()
+	} else if !os.IsNotExist(err) {
+		return info, err
+	} else {
+		entry, ok, err := s.packed(o)
+		if err != nil {
+			return info, err
+		}
+		if !ok {
+			return info, ObjectError{ID: o.Id(), Err: ErrNotFound}
+		}
+		info.Packed = true
+		info.StoredSize = entry.length
+	}
+
+	var err error
+	if info.Codec, err = s.blobCodecName(o); err != nil {
+		return info, err
+	}
+	if info.KeyID, err = s.blobKeyID(o); err != nil {
+		return info, err
+	}
+	chunks, err := s.Recipe(o)
+	if err != nil {
+		return info, err
+	}
+	info.Chunks = len(chunks)
+
+	info.Size, err = s.objectSize(o)
+	return info, err
+}
+
+/* The size of the content of o, from its codec header, or its recipe,
+ * without decoding it where it can be helped. */
+func (s Store) objectSize(o Object) (int64, error) {
+	r, err := s.OpenReader(o)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	return r.Size()
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -1,6 +1,8 @@
 package blobstore
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -14,19 +16,62 @@ import (
 
 // Load {{{
 
+type LoadOptions struct {
+	// Key for object ids, which stores Init'd with one need every time
+	// they're loaded.
+	ObjectIDKey []byte
+}
+
 func Load(path string) (*Store, error) {
-	absPath, err := filepath.Abs(path)
+	return LoadWithOptions(path, LoadOptions{})
+}
+
+func LoadWithOptions(path string, opts LoadOptions) (*Store, error) {
+	store, config, err := load(path)
 	if err != nil {
 		return nil, err
 	}
+	if err := store.applyObjectIDKey(config, opts.ObjectIDKey); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+/* Load the store at p, all but for its object id key. */
+func load(p string) (*Store, Config, error) {
+	absPath, err := filepath.Abs(p)
+	if err != nil {
+		return nil, Config{}, err
+	}
 
-	return &Store{
+	config, err := readConfig(absPath)
+	if err != nil {
+		return nil, Config{}, err
+	}
+	if config.Version == 0 {
+		/* No config; only a store from before there was one will do. */
+		fi, err := os.Stat(path.Join(absPath, ".blobs/store"))
+		if err != nil || !fi.IsDir() {
+			return nil, Config{}, StageError{Path: absPath, Err: ErrNotAStore}
+		}
+	}
+
+	store := &Store{
 		root:           absPath,
 		blobRoot:       ".blobs/store",
 		tempRoot:       ".blobs/new",
+		indexRoot:      ".blobs/index",
+		rawRoot:        ".blobs/raw",
+		packRoot:       ".blobs/packs",
+		packs:          &packCache{},
 		stageRoot:      "",
+		shard:          defaultShardLayout,
 		objectIDHasher: sha256.New,
-	}, nil
+	}
+	if err := store.applyConfig(config); err != nil {
+		return nil, Config{}, err
+	}
+	return store, config, nil
 }
 
 // }}}
@@ -38,15 +83,37 @@ type Store struct {
 	blobRoot  string
 	stageRoot string
 	tempRoot  string
+	indexRoot string
+	rawRoot   string
+	packRoot  string
 
+	// Shard layout blobs are stored in, and the one they're being moved
+	// out of if a Reshard is under way.
+	shard    []int
+	oldShard []int
+
+	packs          *packCache
 	objectIDHasher hashFunc
+	codec          Codec
+	keys           KeyProvider
+	linkCopies     bool
+
+	// Whether new blobs record their size in their codec header, which
+	// they do from format version 3.
+	sizedHeaders bool
 }
 
 // Exists {{{
 
 func (s Store) Exists(o Object) bool {
-	_, err := os.Stat(s.objToPath(o))
-	return !os.IsNotExist(err)
+	if s.validObject(o) != nil {
+		return false
+	}
+	if _, err := os.Stat(s.loosePath(o)); !os.IsNotExist(err) {
+		return true
+	}
+	_, ok, _ := s.packed(o)
+	return ok
 }
 
 // }}}
@@ -54,11 +121,14 @@ func (s Store) Exists(o Object) bool {
 // Open {{{
 
 func (s Store) Open(o Object) (io.ReadCloser, error) {
-	fd, err := os.Open(s.objToPath(o))
-	if err != nil {
+	if err := s.validObject(o); err != nil {
 		return nil, err
 	}
-	return fd, nil
+	raw, err := s.openRaw(o)
+	if err != nil {
+		return nil, s.objectError(o, err)
+	}
+	return s.decode(o, raw)
 }
 
 // }}}
@@ -66,11 +136,23 @@ func (s Store) Open(o Object) (io.ReadCloser, error) {
 // Copy {{{
 
 func (s Store) Copy(o Object, w io.Writer) (int64, error) {
-	fd, err := os.Open(s.objToPath(o))
+	return s.CopyContext(context.Background(), o, w)
+}
+
+func (s Store) CopyContext(ctx context.Context, o Object, w io.Writer) (int64, error) {
+	if err := s.validObject(o); err != nil {
+		return 0, err
+	}
+	raw, err := s.openRaw(o)
+	if err != nil {
+		return 0, s.objectError(o, err)
+	}
+	fd, err := s.decode(o, raw)
 	if err != nil {
 		return 0, err
 	}
-	return io.Copy(w, fd)
+	defer fd.Close()
+	return io.Copy(w, contextReader{ctx: ctx, r: fd})
 }
 
 // }}}
@@ -90,27 +172,105 @@ func (s Store) OpenPath(p string) (io.ReadCloser, error) {
 // Link {{{
 
 func (s Store) Link(o Object, targetPath string) error {
+	if err := s.validObject(o); err != nil {
+		return err
+	}
 	if !s.Exists(o) {
-		return fmt.Errorf("No commited blob: '%s'", o.Id())
+		return ObjectError{ID: o.Id(), Err: ErrNotFound}
 	}
-	storePath := s.objToPath(o)
 	stagePath := s.qualifyStagePath(targetPath)
+	storePath, err := s.linkTarget(o)
+	if err != nil {
+		return err
+	}
 
 	if err := os.MkdirAll(path.Dir(stagePath), 0755); err != nil {
 		return err
 	}
 
-	_, err := os.Stat(stagePath)
+	_, err = os.Lstat(stagePath)
 	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
 	if err == nil {
-		if err := os.Remove(stagePath); err != nil {
+		if err := s.unlink(stagePath); err != nil {
 			return err
 		}
 	}
 
-	return os.Symlink(storePath, stagePath)
+	if err := os.Symlink(storePath, stagePath); err != nil {
+		return err
+	}
+	if err := s.indexAdd(o, stagePath); err != nil {
+		return err
+	}
+	return s.keepLinkTarget(o, storePath)
+}
+
+/* The file a stage link to o should point at. */
+func (s Store) linkTarget(o Object) (string, error) {
+	codecName, err := s.blobCodecName(o)
+	if err != nil {
+		return "", err
+	}
+	if (isEncryptionCodec(codecName) || codecName == recipeCodecName) && !s.linkCopies {
+		return "", ObjectError{ID: o.Id(), Err: ErrNeedsCopy}
+	}
+	if codecName != "" {
+		/* Encoded, so there's no file with the raw bytes to point at. */
+		return s.materialize(o)
+	}
+	return s.unpack(o)
+}
+
+/* Pack may have moved the blob a new link points at into a pack while it
+ * was being made. Pack looks for links made in the meantime once it's
+ * done, and this looks for the blob once the link is made, so one or the
+ * other will notice and put it back. */
+func (s Store) keepLinkTarget(o Object, target string) error {
+	if target != s.objToPath(o) {
+		return nil
+	}
+	if _, err := os.Stat(target); !os.IsNotExist(err) {
+		return err
+	}
+	_, err := s.unpack(o)
+	return err
+}
+
+// }}}
+
+// Unlink {{{
+
+func (s Store) Unlink(targetPath string) error {
+	stagePath := s.qualifyStagePath(targetPath)
+	fi, err := os.Lstat(stagePath)
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSymlink == 0 {
+		return StageError{Path: stagePath, Err: ErrNotALink}
+	}
+	return s.unlink(stagePath)
+}
+
+func (s Store) unlink(stagePath string) error {
+	link, err := os.Readlink(stagePath)
+	if err != nil {
+		/* Not a link (or not there at all), so there's nothing in the
+		 * index to clean up. */
+		return os.Remove(stagePath)
+	}
+	if err := os.Remove(stagePath); err != nil {
+		return err
+	}
+	_, hash := path.Split(link)
+	obj, err := s.ParseObject(hash)
+	if err != nil {
+		/* Not one of ours, so it was never in the index. */
+		return nil
+	}
+	return s.indexRemove(obj, stagePath)
 }
 
 // }}}
@@ -118,11 +278,45 @@ func (s Store) Link(o Object, targetPath string) error {
 // Load {{{
 
 func (s Store) Load(hash string) (*Object, error) {
-	o := Object{id: hash}
+	o, err := s.ParseObject(hash)
+	if err != nil {
+		return nil, err
+	}
 	if s.Exists(o) {
 		return &o, nil
 	}
-	return nil, fmt.Errorf("No such object: '%s'", hash)
+	return nil, ObjectError{ID: hash, Err: ErrNotFound}
+}
+
+// }}}
+
+// Resolve {{{
+
+func (s Store) Resolve(prefix string) (Object, error) {
+	if prefix == "" {
+		return Object{}, InvalidIDError{ID: prefix, Reason: "empty prefix"}
+	}
+	if len(prefix) > s.idLength() || !isHex(prefix) {
+		return Object{}, InvalidIDError{ID: prefix, Reason: "not a valid object id prefix"}
+	}
+
+	candidates := []Object{}
+	err := s.ListVisitor(ListOptions{Prefix: prefix}, func(o Object) error {
+		candidates = append(candidates, o)
+		return nil
+	})
+	if err != nil {
+		return Object{}, err
+	}
+
+	switch len(candidates) {
+	case 0:
+		return Object{}, ObjectError{ID: prefix, Err: ErrNotFound}
+	case 1:
+		return candidates[0], nil
+	default:
+		return Object{}, AmbiguousError{Prefix: prefix, Candidates: candidates}
+	}
 }
 
 // }}}
@@ -130,16 +324,25 @@ func (s Store) Load(hash string) (*Object, error) {
 // Visitor {{{
 
 func (s Store) LinkedVisitor(progn func(Object, string, os.FileInfo) error) error {
-	blobRoot := path.Clean(path.Join(s.root, s.blobRoot))
+	return s.LinkedVisitorContext(context.Background(), progn)
+}
+
+func (s Store) LinkedVisitorContext(ctx context.Context, progn func(Object, string, os.FileInfo) error) error {
 	return filepath.Walk(
 		path.Join(s.root, s.stageRoot),
 		func(p string, f os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
 			p = path.Clean(p)
 
 			/* For each file in the stage (but anything that's not in the
 			 * blob root), let's read the link. If it's a symlink, call the
 			 * visitor, and move on */
-			if f.IsDir() || strings.HasPrefix(path.Clean(p), blobRoot) {
+			if f.IsDir() || s.isStorePath(p) {
 				return nil
 			}
 			link, err := os.Readlink(p)
@@ -148,13 +351,16 @@ func (s Store) LinkedVisitor(progn func(Object, string, os.FileInfo) error) erro
 				return nil
 			}
 
-			if !strings.HasPrefix(path.Clean(link), blobRoot) {
+			if !s.isStorePath(link) {
 				/* If the link is pointing outside the blobRoot, we don't
 				 * care to visit it */
 				return nil
 			}
 			_, hash := path.Split(link)
-			obj := Object{id: hash}
+			obj, err := s.ParseObject(hash)
+			if err != nil {
+				return nil
+			}
 			return progn(obj, p, f)
 		},
 	)
@@ -165,8 +371,19 @@ func (s Store) LinkedVisitor(progn func(Object, string, os.FileInfo) error) erro
 // Linked {{{
 
 func (s Store) Linked() (map[Object][]string, error) {
+	return s.LinkedContext(context.Background())
+}
+
+func (s Store) LinkedContext(ctx context.Context) (map[Object][]string, error) {
 	seen := map[Object][]string{}
-	err := s.LinkedVisitor(func(obj Object, p string, info os.FileInfo) error {
+	if s.Indexed() {
+		err := s.indexVisitor(ctx, func(obj Object, p string) error {
+			seen[obj] = append(seen[obj], p)
+			return nil
+		})
+		return seen, err
+	}
+	err := s.LinkedVisitorContext(ctx, func(obj Object, p string, info os.FileInfo) error {
 		seen[obj] = append(seen[obj], p)
 		return nil
 	})
@@ -178,8 +395,19 @@ func (s Store) Linked() (map[Object][]string, error) {
 // Paths {{{
 
 func (s Store) Paths() (map[string]Object, error) {
+	return s.PathsContext(context.Background())
+}
+
+func (s Store) PathsContext(ctx context.Context) (map[string]Object, error) {
 	seen := map[string]Object{}
-	err := s.LinkedVisitor(func(obj Object, p string, info os.FileInfo) error {
+	if s.Indexed() {
+		err := s.indexVisitor(ctx, func(obj Object, p string) error {
+			seen[p] = obj
+			return nil
+		})
+		return seen, err
+	}
+	err := s.LinkedVisitorContext(ctx, func(obj Object, p string, info os.FileInfo) error {
 		seen[p] = obj
 		return nil
 	})
@@ -191,24 +419,18 @@ func (s Store) Paths() (map[string]Object, error) {
 // List {{{
 
 func (s Store) List() ([]Object, error) {
-	objectList := []Object{}
-
-	err := filepath.Walk(
-		path.Join(s.root, s.blobRoot),
-		func(p string, f os.FileInfo, err error) error {
-			if f.IsDir() {
-				return nil
-			}
-			_, hash := path.Split(p)
-			objectList = append(objectList, Object{id: hash})
-			return nil
-		},
-	)
+	return s.ListContext(context.Background())
+}
 
+func (s Store) ListContext(ctx context.Context) ([]Object, error) {
+	objectList := []Object{}
+	err := s.ListVisitorContext(ctx, ListOptions{}, func(o Object) error {
+		objectList = append(objectList, o)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-
 	return objectList, nil
 }
 
@@ -217,17 +439,51 @@ func (s Store) List() ([]Object, error) {
 // GC {{{
 
 func (s Store) GC(gc GarbageCollector) error {
-	nodes, err := gc.Find(s)
+	return s.GCContext(context.Background(), gc)
+}
+
+func (s Store) GCContext(ctx context.Context, gc GarbageCollector) error {
+	_, err := s.CollectContext(ctx, gc)
+	return err
+}
+
+/* Like GC, but return the Objects it removed. */
+func (s Store) Collect(gc GarbageCollector) ([]Object, error) {
+	return s.CollectContext(context.Background(), gc)
+}
+
+func (s Store) CollectContext(ctx context.Context, gc GarbageCollector) ([]Object, error) {
+	unlock, err := s.lock("gc")
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer unlock()
 
+	var nodes []Object
+	if cgc, ok := gc.(ContextGarbageCollector); ok {
+		nodes, err = cgc.FindContext(ctx, s)
+	} else {
+		nodes, err = gc.Find(s)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	removed := []Object{}
 	for _, node := range nodes {
-		if err := s.Remove(node); err != nil {
-			return err
+		if err := ctx.Err(); err != nil {
+			return removed, err
 		}
+		err := s.Remove(node)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return removed, err
+		}
+		removed = append(removed, node)
 	}
-	return nil
+	return removed, nil
 }
 
 // }}}
@@ -235,12 +491,33 @@ func (s Store) GC(gc GarbageCollector) error {
 // Remove {{{
 
 func (s Store) Remove(o Object) error {
+	if err := s.validObject(o); err != nil {
+		return err
+	}
 	if !s.Exists(o) {
-		return fmt.Errorf("No such object: '%s'", o.Id())
+		return ObjectError{ID: o.Id(), Err: ErrNotFound}
 	}
 
-	path := s.objToPath(o)
-	return os.Remove(path)
+	rawPath := path.Join(s.root, s.rawRoot, s.objShardPath(o))
+	if err := os.Remove(rawPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(s.objToPath(o)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if s.oldShard != nil {
+		oldPath := s.qualifyBlobPath(shardPath(s.oldShard, o))
+		if err := os.Remove(oldPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := s.Unpin(o); err != nil {
+		return err
+	}
+	if _, ok, _ := s.packed(o); ok {
+		return s.removePacked(o)
+	}
+	return nil
 }
 
 // }}}
@@ -259,17 +536,67 @@ func (s Store) Create() (*Writer, error) {
 		return nil, err
 	}
 	hashWriter := s.objectIDHasher()
+	written := new(int64)
+
+	if s.codec == nil && s.keys == nil {
+		return &Writer{
+			path:    fd.Name(),
+			writer:  fd,
+			target:  io.MultiWriter(fd, hashWriter, countingWriter{written}),
+			hash:    hashWriter,
+			written: written,
+		}, nil
+	}
 
+	encoder, sizeAt, err := s.newEncoder(fd)
+	if err != nil {
+		fd.Close()
+		os.Remove(fd.Name())
+		return nil, err
+	}
 	return &Writer{
-		path:   fd.Name(),
-		writer: fd,
-		target: io.MultiWriter(fd, hashWriter),
-		hash:   hashWriter,
+		path:    fd.Name(),
+		writer:  fd,
+		encoder: encoder,
+		target:  io.MultiWriter(encoder, hashWriter, countingWriter{written}),
+		hash:    hashWriter,
+		written: written,
+		sizeAt:  sizeAt,
 	}, nil
 }
 
 // }}}
 
+// Verify {{{
+
+func (s Store) Verify(o Object) error {
+	return s.VerifyContext(context.Background(), o)
+}
+
+func (s Store) VerifyContext(ctx context.Context, o Object) error {
+	hash := s.objectIDHasher()
+	if _, err := s.CopyContext(ctx, o, hash); err != nil {
+		return err
+	}
+	if fmt.Sprintf("%x", hash.Sum(nil)) != o.Id() {
+		return ObjectError{ID: o.Id(), Err: ErrCorrupt}
+	}
+	return nil
+}
+
+// }}}
+
+// error helpers {{{
+
+func (s Store) objectError(o Object, err error) error {
+	if os.IsNotExist(err) {
+		return ObjectError{ID: o.Id(), Err: ErrNotFound}
+	}
+	return err
+}
+
+// }}}
+
 // path helpers {{{
 
 func (s Store) qualifyBlobPath(p string) string {
@@ -280,9 +607,51 @@ func (s Store) qualifyStagePath(p string) string {
 	return path.Join(s.root, s.stageRoot, p)
 }
 
+/* Both blobRoot and rawRoot hold things stage links may point at, and
+ * neither are part of the stage themselves. */
+func (s Store) isStorePath(p string) bool {
+	p = path.Clean(p)
+	for _, root := range []string{s.blobRoot, s.rawRoot} {
+		if strings.HasPrefix(p, path.Clean(path.Join(s.root, root))) {
+			return true
+		}
+	}
+	return false
+}
+
+/* Whether p is the store's own metadata directory, or anything in it. */
+func (s Store) isMetaPath(p string) bool {
+	p = path.Clean(p)
+	metaRoot := path.Join(s.root, path.Dir(s.blobRoot))
+	return p == metaRoot || strings.HasPrefix(p, metaRoot+"/")
+}
+
+/* Where o is, or would be, written under blobRoot. */
 func (s Store) objToPath(o Object) string {
-	id := o.Id()
-	return s.qualifyBlobPath(path.Join(id[0:1], id[1:2], id[2:6], id))
+	return s.qualifyBlobPath(shardPath(s.shard, o))
+}
+
+/* Where to read o from under blobRoot; the same as objToPath, unless a
+ * Reshard is under way and o hasn't been moved yet. */
+func (s Store) loosePath(o Object) string {
+	p := s.objToPath(o)
+	if s.oldShard == nil {
+		return p
+	}
+	if _, err := os.Stat(p); err == nil {
+		return p
+	}
+	oldPath := s.qualifyBlobPath(shardPath(s.oldShard, o))
+	if _, err := os.Stat(oldPath); err == nil {
+		return oldPath
+	}
+	return p
+}
+
+/* The index and raw copies always use the default layout, whatever the
+ * blobs do, so a Reshard never has to move them. */
+func (s Store) objShardPath(o Object) string {
+	return shardPath(defaultShardLayout, o)
 }
 
 // }}}
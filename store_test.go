@@ -0,0 +1,188 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+	store, err := Init(t.TempDir(), InitOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func putString(t *testing.T, store *Store, content string) Object {
+	t.Helper()
+	o, err := store.Put(strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *o
+}
+
+func readString(t *testing.T, store *Store, o Object) string {
+	t.Helper()
+	rc, err := store.Open(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestCollect(t *testing.T) {
+	store := newTestStore(t)
+	kept := putString(t, store, "kept")
+	gone := putString(t, store, "gone")
+	if err := store.Link(kept, "kept"); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := store.Collect(DumbGarbageCollector{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0] != gone {
+		t.Fatalf("removed %v, wanted only %s", removed, gone.Id())
+	}
+	if !store.Exists(kept) || store.Exists(gone) {
+		t.Fatal("GC removed the wrong thing")
+	}
+}
+
+/* A stage that can't be walked is an error, not a panic. */
+func TestLinkedMissingStage(t *testing.T) {
+	store := newTestStore(t)
+	if err := os.RemoveAll(store.root); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Linked(); !os.IsNotExist(err) {
+		t.Fatalf("listing links in a missing stage: %v", err)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	store := newTestStore(t)
+	objects := []Object{}
+	for i := 0; i < 20; i++ {
+		objects = append(objects, putString(t, store, fmt.Sprintf("resolve %d", i)))
+	}
+	loose := objects[0]
+	if err := store.Link(loose, "loose"); err != nil {
+		t.Fatal(err)
+	}
+	/* Everything else goes into a pack, which Resolve has to look in. */
+	if err := store.Pack(context.Background(), 1024); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := store.packed(objects[1]); !ok {
+		t.Fatal("nothing was packed")
+	}
+
+	/* Twenty ids over sixteen leading digits, so some short prefixes
+	 * have to be ambiguous. */
+	ambiguous := 0
+	for _, o := range objects {
+		for n := 1; n <= len(o.Id()); n++ {
+			prefix := o.Id()[:n]
+			want := []Object{}
+			for _, other := range objects {
+				if strings.HasPrefix(other.Id(), prefix) {
+					want = append(want, other)
+				}
+			}
+			got, err := store.Resolve(prefix)
+			if len(want) == 1 {
+				if err != nil || got != o {
+					t.Fatalf("%s resolved to %s, %v", prefix, got.Id(), err)
+				}
+				continue
+			}
+			var amb AmbiguousError
+			if !errors.As(err, &amb) {
+				t.Fatalf("%s: %v", prefix, err)
+			}
+			sortObjects(amb.Candidates)
+			sortObjects(want)
+			if !reflect.DeepEqual(amb.Candidates, want) {
+				t.Fatalf("%s: candidates %v, wanted %v", prefix, amb.Candidates, want)
+			}
+			ambiguous++
+		}
+	}
+	if ambiguous == 0 {
+		t.Fatal("no prefix was ambiguous")
+	}
+
+	/* And 256 two digit prefixes can't all be taken. */
+	for i := 0; i < 256; i++ {
+		prefix := fmt.Sprintf("%02x", i)
+		taken := false
+		for _, o := range objects {
+			taken = taken || strings.HasPrefix(o.Id(), prefix)
+		}
+		if !taken {
+			if _, err := store.Resolve(prefix); !errors.Is(err, ErrNotFound) {
+				t.Fatalf("%s: %v", prefix, err)
+			}
+			break
+		}
+	}
+
+	for _, prefix := range []string{"", "xyz", "ABC", "../", loose.Id() + "0"} {
+		if _, err := store.Resolve(prefix); !errors.Is(err, ErrInvalidID) {
+			t.Fatalf("%q: %v", prefix, err)
+		}
+	}
+}
+
+/* Ids come in from users and over the network, and end up in paths; bad
+ * ones have to be turned away before they get anywhere near the disk. */
+func TestInvalidID(t *testing.T) {
+	store := newTestStore(t)
+	o := putString(t, store, "valid")
+	if err := store.Link(o, "valid"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{
+		"",
+		o.Id()[:10],
+		strings.ToUpper(o.Id()),
+		"../" + o.Id()[3:],
+		"../../../../../../etc/passwd",
+		o.Id() + "00",
+	} {
+		if _, err := store.Load(id); !errors.Is(err, ErrInvalidID) {
+			t.Fatalf("Load(%q): %v", id, err)
+		}
+		bad := Object{id: id}
+		if store.Exists(bad) {
+			t.Fatalf("Exists(%q)", id)
+		}
+		if _, err := store.Open(bad); !errors.Is(err, ErrInvalidID) {
+			t.Fatalf("Open(%q): %v", id, err)
+		}
+		if err := store.Remove(bad); !errors.Is(err, ErrInvalidID) {
+			t.Fatalf("Remove(%q): %v", id, err)
+		}
+	}
+	if got := readString(t, store, o); got != "valid" {
+		t.Fatalf("read back %q", got)
+	}
+}
+
+// vim: foldmethod=marker
@@ -0,0 +1,370 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+type WalkOptions struct {
+	// Number of concurrent workers to use. Anything less than one means
+	// one worker per CPU.
+	Workers int
+
+	// Sort the results before returning them, rather than handing them
+	// back in whatever order the workers finished in.
+	Sorted bool
+}
+
+func (o WalkOptions) workers() int {
+	if o.Workers < 1 {
+		return runtime.NumCPU()
+	}
+	return o.Workers
+}
+
+// ListParallel {{{
+
+func (s Store) ListParallel(ctx context.Context, opts WalkOptions) ([]Object, error) {
+	if s.oldShard != nil {
+		/* Mid-Reshard there are two layouts to fan out over; take the
+		 * slow path until it's done. */
+		return s.ListContext(ctx)
+	}
+
+	/* The shard layout gives us a fixed fan-out, so rather than walk it
+	 * from the top, enumerate the first two levels of shard directories
+	 * and hand each one of those to a worker. */
+	type shard struct {
+		dir   string
+		soFar string
+	}
+	shards := []shard{{dir: path.Join(s.root, s.blobRoot)}}
+	depth := 0
+	for ; depth < 2 && depth < len(s.shard); depth++ {
+		next := []shard{}
+		for _, sh := range shards {
+			entries, err := ioutil.ReadDir(sh.dir)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			for _, entry := range entries {
+				if entry.IsDir() && len(entry.Name()) == s.shard[depth] {
+					next = append(next, shard{
+						dir:   path.Join(sh.dir, entry.Name()),
+						soFar: sh.soFar + entry.Name(),
+					})
+				}
+			}
+		}
+		shards = next
+	}
+
+	lock := sync.Mutex{}
+	ret := []Object{}
+	err := forEach(ctx, opts.workers(), len(shards), func(ctx context.Context, i int) error {
+		found := []Object{}
+		err := s.listDir(ctx, shards[i].dir, s.shard, depth, shards[i].soFar, ListOptions{}, func(o Object) error {
+			found = append(found, o)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		lock.Lock()
+		ret = append(ret, found...)
+		lock.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	_, packed, err := s.packIndex()
+	if err != nil {
+		return nil, err
+	}
+	if len(packed) > 0 {
+		loose := map[Object]bool{}
+		for _, o := range ret {
+			loose[o] = true
+		}
+		for _, o := range packed {
+			if !loose[o] {
+				ret = append(ret, o)
+			}
+		}
+	}
+
+	if opts.Sorted {
+		sortObjects(ret)
+	}
+	return ret, nil
+}
+
+// }}}
+
+// LinkedParallel {{{
+
+func (s Store) LinkedParallel(ctx context.Context, opts WalkOptions) (map[Object][]string, error) {
+	if s.Indexed() {
+		seen, err := s.LinkedContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if opts.Sorted {
+			for _, paths := range seen {
+				sort.Strings(paths)
+			}
+		}
+		return seen, nil
+	}
+
+	/* Each directory in the stage is its own unit of work. A fixed pool
+	 * of workers takes them off a queue, and reading one queues up its
+	 * subdirectories; pending counts those queued or being read, so the
+	 * workers know they're done once it's back down to zero. */
+	var (
+		lock     = sync.Mutex{}
+		cond     = sync.NewCond(&lock)
+		queue    = []string{path.Clean(path.Join(s.root, s.stageRoot))}
+		pending  = 1
+		seen     = map[Object][]string{}
+		firstErr error
+	)
+	next := func() (string, bool) {
+		lock.Lock()
+		defer lock.Unlock()
+		for len(queue) == 0 && pending > 0 && firstErr == nil {
+			cond.Wait()
+		}
+		if len(queue) == 0 || firstErr != nil {
+			return "", false
+		}
+		dir := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		return dir, true
+	}
+	done := func(subdirs []string, found map[Object][]string, err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if err == nil {
+			err = ctx.Err()
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		queue = append(queue, subdirs...)
+		pending += len(subdirs) - 1
+		for obj, paths := range found {
+			seen[obj] = append(seen[obj], paths...)
+		}
+		cond.Broadcast()
+	}
+
+	wg := sync.WaitGroup{}
+	for w := 0; w < opts.workers(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				dir, ok := next()
+				if !ok {
+					return
+				}
+				done(s.readStageDir(dir))
+			}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if opts.Sorted {
+		for _, paths := range seen {
+			sort.Strings(paths)
+		}
+	}
+	return seen, nil
+}
+
+/* The subdirectories of the stage directory dir, and the links into the
+ * store in it. */
+func (s Store) readStageDir(dir string) ([]string, map[Object][]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	subdirs := []string{}
+	found := map[Object][]string{}
+	for _, entry := range entries {
+		p := path.Join(dir, entry.Name())
+		if s.isStorePath(p) {
+			continue
+		}
+		if entry.IsDir() {
+			subdirs = append(subdirs, p)
+			continue
+		}
+		link, err := os.Readlink(p)
+		if err != nil || !s.isStorePath(link) {
+			continue
+		}
+		_, hash := path.Split(link)
+		obj, err := s.ParseObject(hash)
+		if err != nil {
+			continue
+		}
+		found[obj] = append(found[obj], p)
+	}
+	return subdirs, found, nil
+}
+
+// }}}
+
+// Fsck {{{
+
+func (s Store) Fsck(ctx context.Context, opts WalkOptions) ([]Object, error) {
+	objects, err := s.ListParallel(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	lock := sync.Mutex{}
+	corrupt := []Object{}
+	err = forEach(ctx, opts.workers(), len(objects), func(ctx context.Context, i int) error {
+		err := s.VerifyContext(ctx, objects[i])
+		switch {
+		case err == nil, errors.Is(err, ErrNotFound):
+			/* Gone since we listed it; that's GC's business, not ours. */
+			return nil
+		case errors.Is(err, ErrCorrupt):
+			lock.Lock()
+			corrupt = append(corrupt, objects[i])
+			lock.Unlock()
+			return nil
+		default:
+			return err
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Sorted {
+		sortObjects(corrupt)
+	}
+	return corrupt, nil
+}
+
+// }}}
+
+// helpers {{{
+
+func forEach(ctx context.Context, workers, n int, fn func(context.Context, int) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobs := make(chan int)
+	wg := sync.WaitGroup{}
+	once := sync.Once{}
+	var firstErr error
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if err := fn(ctx, i); err != nil {
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+
+feed:
+	for i := 0; i < n; i++ {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+/* Like forEach, but over the Objects feed sends, as it finds them, rather
+ * than a count known up front. send fails once there's no point feeding
+ * any more. */
+func forEachObject(ctx context.Context, workers int, feed func(send func(Object) error) error, fn func(context.Context, Object) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobs := make(chan Object)
+	wg := sync.WaitGroup{}
+	once := sync.Once{}
+	var firstErr error
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for o := range jobs {
+				if err := fn(ctx, o); err != nil {
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+
+	feedErr := feed(func(o Object) error {
+		select {
+		case jobs <- o:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	close(jobs)
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	if feedErr != nil {
+		return feedErr
+	}
+	return ctx.Err()
+}
+
+func sortObjects(objects []Object) {
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Id() < objects[j].Id()
+	})
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,103 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+/* A store with objects linked all over a stage a few directories deep, and
+ * one object corrupted behind the store's back. */
+func newWalkStore(t *testing.T) (*Store, Object) {
+	t.Helper()
+	store := newTestStore(t)
+	for i := 0; i < 40; i++ {
+		o := putString(t, store, fmt.Sprintf("object %d", i))
+		if i%3 == 0 {
+			continue
+		}
+		for _, p := range []string{
+			fmt.Sprintf("top-%d", i),
+			fmt.Sprintf("a/%d/b/%d", i%4, i),
+			fmt.Sprintf("c/d/e/%d", i%5),
+		} {
+			if err := store.Link(o, p); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	bad := putString(t, store, "about to go bad")
+	if err := ioutil.WriteFile(store.loosePath(bad), []byte("gone bad"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return store, bad
+}
+
+func TestWalkParallel(t *testing.T) {
+	store, bad := newWalkStore(t)
+	ctx := context.Background()
+
+	list, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sortObjects(list)
+	linked, err := store.Linked()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, paths := range linked {
+		sort.Strings(paths)
+	}
+
+	for _, workers := range []int{1, 4, 0} {
+		opts := WalkOptions{Workers: workers, Sorted: true}
+
+		got, err := store.ListParallel(ctx, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, list) {
+			t.Fatalf("%d workers: ListParallel gave %d objects, List %d", workers, len(got), len(list))
+		}
+
+		gotLinked, err := store.LinkedParallel(ctx, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(gotLinked, linked) {
+			t.Fatalf("%d workers: LinkedParallel gave %v, Linked %v", workers, gotLinked, linked)
+		}
+
+		corrupt, err := store.Fsck(ctx, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(corrupt) != 1 || corrupt[0] != bad {
+			t.Fatalf("%d workers: Fsck found %v, wanted only %s", workers, corrupt, bad.Id())
+		}
+	}
+}
+
+func TestWalkParallelCancelled(t *testing.T) {
+	store, _ := newWalkStore(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	opts := WalkOptions{Workers: 4}
+
+	if _, err := store.ListParallel(ctx, opts); !errors.Is(err, context.Canceled) {
+		t.Fatalf("ListParallel: %v", err)
+	}
+	if _, err := store.LinkedParallel(ctx, opts); !errors.Is(err, context.Canceled) {
+		t.Fatalf("LinkedParallel: %v", err)
+	}
+	if _, err := store.Fsck(ctx, opts); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Fsck: %v", err)
+	}
+}
+
+// vim: foldmethod=marker
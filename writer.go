@@ -9,10 +9,26 @@ import (
 )
 
 type Writer struct {
-	path   string
-	writer io.WriteCloser
-	target io.Writer
-	hash   hash.Hash
+	path    string
+	writer  io.WriteCloser
+	encoder io.WriteCloser
+	chunker *chunker
+	target  io.Writer
+	hash    hash.Hash
+
+	// How much content has been written, and where in the file that goes
+	// once it's all there (if anywhere).
+	written *int64
+	sizeAt  int64
+}
+
+type countingWriter struct {
+	n *int64
+}
+
+func (c countingWriter) Write(b []byte) (int, error) {
+	*c.n += int64(len(b))
+	return len(b), nil
 }
 
 // io.WriteCloser interface {{{
@@ -22,35 +38,132 @@ func (n Writer) Write(b []byte) (int, error) {
 }
 
 func (n Writer) Close() error {
+	if n.encoder != nil {
+		if err := n.encoder.Close(); err != nil {
+			n.writer.Close()
+			return err
+		}
+	}
 	return n.writer.Close()
 }
 
+/* The id the content written so far would be committed as. */
+func (n Writer) Id() string {
+	return fmt.Sprintf("%x", n.hash.Sum(nil))
+}
+
+/* Throw away everything written, rather than committing it. */
+func (n Writer) Abort() error {
+	n.Close()
+	if n.chunker != nil {
+		if err := n.chunker.unpin(); err != nil {
+			os.Remove(n.path)
+			return err
+		}
+	}
+	return os.Remove(n.path)
+}
+
 // }}}
 
 // Commit {{{
 
+/* Commit the content written to w, and return its Object. If the store
+ * already has that Object, the blob already there is kept as it is. */
 func (s Store) Commit(w Writer) (*Object, error) {
-	err := w.writer.Close()
+	return s.commit(w, false)
+}
+
+/* Commit w, replacing any blob already there with the new one when
+ * replace is set. */
+func (s Store) commit(w Writer, replace bool) (*Object, error) {
+	if w.chunker != nil {
+		defer w.chunker.unpin()
+		var recipe io.Writer = w.writer
+		if w.encoder != nil {
+			recipe = w.encoder
+		}
+		if err := w.chunker.writeRecipe(recipe, w.encoder == nil); err != nil {
+			w.Close()
+			return nil, err
+		}
+	}
+	err := w.Close()
 	if err != nil {
 		return nil, err
 	}
-	oid := fmt.Sprintf("%x", w.hash.Sum(nil))
-	obj := Object{id: oid}
-	objPath := s.objToPath(obj)
-	if err := os.MkdirAll(path.Dir(objPath), 0755); err != nil {
-		return nil, err
+	if w.encoder == nil && w.chunker == nil {
+		if err := s.escapeRawBlob(w.path); err != nil {
+			return nil, err
+		}
 	}
-	err = os.Chmod(w.path, 0644)
-	if err != nil {
-		return nil, err
+	if w.sizeAt > 0 {
+		if err := patchCodecSize(w.path, w.sizeAt, *w.written); err != nil {
+			return nil, err
+		}
 	}
-	err = os.Rename(w.path, objPath)
-	if err != nil {
+	if w.chunker != nil {
+		if err := w.chunker.check(); err != nil {
+			os.Remove(w.path)
+			return nil, err
+		}
+	}
+	obj := Object{id: w.Id()}
+	place := s.commitNew
+	if replace {
+		place = s.commitFile
+	}
+	if err := place(w.path, obj); err != nil {
 		return nil, err
 	}
 	return &obj, nil
 }
 
+/* Every blob is committed with blobMode, so it's also what every link into
+ * the store reads as, whatever the file it was made from had. */
+const blobMode os.FileMode = 0644
+
+/* Move the finished blob at p into place as o, replacing whatever was
+ * there. */
+func (s Store) commitFile(p string, o Object) error {
+	return s.placeFile(p, o, os.Rename)
+}
+
+/* Like commitFile, but if the store already has o, keep that and drop p.
+ * The blob there may be encoded differently, and stage links may point
+ * straight at it, expecting its bytes to stay as they are. */
+func (s Store) commitNew(p string, o Object) error {
+	if s.Exists(o) {
+		return os.Remove(p)
+	}
+	/* A link, rather than a rename, so if someone else commits o in the
+	 * meantime, theirs wins. */
+	if err := s.placeFile(p, o, os.Link); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return os.Remove(p)
+}
+
+func (s Store) placeFile(p string, o Object, place func(string, string) error) error {
+	objPath := s.objToPath(o)
+	if err := os.MkdirAll(path.Dir(objPath), 0755); err != nil {
+		return err
+	}
+	if err := os.Chmod(p, blobMode); err != nil {
+		return err
+	}
+	err := place(p, objPath)
+	if os.IsNotExist(err) {
+		/* Someone (a Reshard on another layout, say) cleared away the
+		 * shard directory before we got to it; make it again. */
+		if err := os.MkdirAll(path.Dir(objPath), 0755); err != nil {
+			return err
+		}
+		err = place(p, objPath)
+	}
+	return err
+}
+
 // }}}
 
 // vim: foldmethod=marker